@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+)
+
+// answerCheck is a requirement on the answer that the backends do not
+// guarantee. The proxy checks the non-streaming answer before the client sees
+// it and asks the upstream once more when it fails.
+type answerCheck interface {
+	// check returns why the answer fails. It may repair the answer in place.
+	check(completion *chatCompletion) error
+
+	// retry returns the request that asks again after answer failed with err.
+	retry(chatReq *ChatRequest, answer *chatCompletion, err error) *ChatRequest
+
+	// strict rejects an answer that fails twice instead of passing it on.
+	strict() bool
+}
+
+// errAnswerRejected is returned for answers that failed a strict check twice.
+type errAnswerRejected struct {
+	err error
+}
+
+func (e *errAnswerRejected) Error() string {
+	return fmt.Sprintf("the upstream answer failed validation: %v", e.err)
+}
+
+// runChecks returns the first failing check and its error.
+func runChecks(checks []answerCheck, completion *chatCompletion) (answerCheck, error) {
+	for _, c := range checks {
+		if err := c.check(completion); err != nil {
+			return c, err
+		}
+	}
+	return nil, nil
+}
+
+// discardedUsage adds up the usage of answers that were not served because
+// they failed a check.
+type discardedUsage struct {
+	usage     *Usage
+	estimated bool
+}
+
+// add counts an answer to req, estimating its usage when none was reported.
+func (d *discardedUsage) add(req *ChatRequest, completion *chatCompletion) {
+	usage := completion.Usage
+	if usage == nil {
+		prompt := estimatePromptTokens(req)
+		answer := estimateTokens(completion.result().content)
+		usage = &Usage{PromptTokens: prompt, CompletionTokens: answer, TotalTokens: prompt + answer}
+		d.estimated = true
+	}
+	d.usage = d.usage.plus(usage)
+}
+
+// enforceAnswer checks the non-streaming answer in resp and asks the target
+// once more when it fails a check. It returns the translated answer as the
+// response of a backend whose TranslateResponse passes it through, so the
+// usual handlers can serve it, and the usage of the answers it discarded,
+// whatever the outcome.
+func enforceAnswer(ctx context.Context, r *http.Request, chatReq *ChatRequest, checks []answerCheck, target upstreamTarget, resp *http.Response, originalModel string) (upstreamTarget, *http.Response, discardedUsage, error) {
+	var discarded discardedUsage
+	req := chatReq
+	for retried := false; ; retried = true {
+		body, err := readResponse(resp)
+		resp.Body.Close()
+		if err != nil {
+			return target, nil, discarded, fmt.Errorf("error reading response: %v", err)
+		}
+		translated, err := target.backend.TranslateResponse(body, target.translation, originalModel)
+		if err != nil {
+			return target, nil, discarded, fmt.Errorf("error translating %s response: %v", target.backend.Name(), err)
+		}
+		var completion chatCompletion
+		if err := json.Unmarshal(translated, &completion); err != nil {
+			return target, nil, discarded, fmt.Errorf("error parsing %s response: %v", target.backend.Name(), err)
+		}
+
+		failed, checkErr := runChecks(checks, &completion)
+		if checkErr != nil && !retried {
+			log.Printf("%s answer failed validation, retrying once: %v", target.backend.Name(), checkErr)
+			discarded.add(req, &completion)
+			req = failed.retry(req, &completion, checkErr)
+			var sent upstreamTarget
+			sent, resp, err = sendWithFallback(ctx, r, req, []upstreamTarget{target})
+			if err != nil {
+				return target, nil, discarded, err
+			}
+			target = sent
+			if resp.StatusCode >= 400 {
+				return target, resp, discarded, nil
+			}
+			continue
+		}
+		if checkErr != nil {
+			if failed.strict() {
+				discarded.add(req, &completion)
+				return target, nil, discarded, &errAnswerRejected{checkErr}
+			}
+			log.Printf("%s answer still failed validation, returning it: %v", target.backend.Name(), checkErr)
+		}
+
+		if translated, err = json.Marshal(&completion); err != nil {
+			return target, nil, discarded, err
+		}
+		resp.Header.Del("Content-Encoding")
+		resp.Body = io.NopCloser(bytes.NewReader(translated))
+		return upstreamTarget{backend: checkedBackend{target.backend}, model: target.model}, resp, discarded, nil
+	}
+}
+
+// checkedBackend serves an answer that was already translated and checked.
+type checkedBackend struct {
+	Backend
+}
+
+func (checkedBackend) TranslateResponse(body []byte, tr translation, originalModel string) ([]byte, error) {
+	return body, nil
+}
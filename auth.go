@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+const clientKeyPrefix = "sk-proxy-"
+
+// ClientConfig is an access key the proxy issues to one of its own clients.
+// Clients never see the upstream provider keys, so a leaked key can be
+// revoked by removing or disabling it here.
+type ClientConfig struct {
+	Name     string `yaml:"name"`
+	Key      string `yaml:"key"`
+	Disabled bool   `yaml:"disabled"`
+
+	// Admin clients may query the usage of every client
+	Admin bool `yaml:"admin"`
+
+	// RateLimits overrides the global rate limits for this client
+	RateLimits *RateLimitConfig `yaml:"rate_limits"`
+
+	// Budget overrides budgets.clients for this client
+	Budget *BudgetConfig `yaml:"budget"`
+}
+
+// clientIdentity is the authenticated caller of a request.
+type clientIdentity struct {
+	name   string
+	admin  bool
+	limits RateLimitConfig
+}
+
+// generateClientKey returns a new random client access key.
+func generateClientKey() (string, error) {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return clientKeyPrefix + hex.EncodeToString(buf), nil
+}
+
+// parseClientConfigs parses CLIENT_KEYS: comma separated "name:key" pairs.
+func parseClientConfigs(spec string) []ClientConfig {
+	var clients []ClientConfig
+	for _, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		name, key, _ := strings.Cut(pair, ":")
+		clients = append(clients, ClientConfig{
+			Name: strings.TrimSpace(name),
+			Key:  strings.TrimSpace(key),
+		})
+	}
+	return clients
+}
+
+// validateClients checks the client keys and returns the enabled ones.
+func validateClients(clients []ClientConfig, providerKeys []string) ([]ClientConfig, error) {
+	names := map[string]bool{}
+	keys := map[string]bool{}
+	var enabled []ClientConfig
+	for _, c := range clients {
+		if c.Name == "" {
+			return nil, errors.New("client without name")
+		}
+		if c.Key == "" {
+			return nil, fmt.Errorf("client %s has no key", c.Name)
+		}
+		if names[c.Name] {
+			return nil, fmt.Errorf("duplicate client name %s", c.Name)
+		}
+		if keys[c.Key] {
+			return nil, fmt.Errorf("client %s reuses another client's key", c.Name)
+		}
+		for _, pk := range providerKeys {
+			if c.Key == pk {
+				return nil, fmt.Errorf("client %s uses an upstream provider key", c.Name)
+			}
+		}
+		if c.RateLimits != nil {
+			if err := c.RateLimits.validate(); err != nil {
+				return nil, fmt.Errorf("client %s: %v", c.Name, err)
+			}
+		}
+		names[c.Name] = true
+		keys[c.Key] = true
+
+		if !c.Disabled {
+			enabled = append(enabled, c)
+		}
+	}
+	return enabled, nil
+}
+
+// authenticate identifies the caller from its Bearer token. With client keys
+// configured only the enabled ones are accepted, so disabling the last key
+// locks everyone out. Otherwise the proxy falls back to the old behaviour of
+// accepting the upstream provider keys, and accepts every caller when there
+// are none (Ollama only).
+func (st *proxyState) authenticate(w http.ResponseWriter, r *http.Request) (*clientIdentity, bool) {
+	if !st.clientKeys && len(st.providerKeys) == 0 {
+		return &clientIdentity{name: "anonymous", admin: true, limits: st.config.RateLimits}, true
+	}
+
+	authHeader := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authHeader, "Bearer ") {
+		log.Printf("Missing or invalid Authorization header")
+		http.Error(w, "Missing or invalid Authorization header", http.StatusUnauthorized)
+		return nil, false
+	}
+
+	userAPIKey := strings.TrimPrefix(authHeader, "Bearer ")
+	if st.clientKeys {
+		for _, c := range st.clients {
+			if subtle.ConstantTimeCompare([]byte(userAPIKey), []byte(c.Key)) == 1 {
+				limits := st.config.RateLimits
+				if c.RateLimits != nil {
+					limits = *c.RateLimits
+				}
+				return &clientIdentity{name: c.Name, admin: c.Admin, limits: limits}, true
+			}
+		}
+	} else {
+		for _, key := range st.providerKeys {
+			if subtle.ConstantTimeCompare([]byte(userAPIKey), []byte(key)) == 1 {
+				return &clientIdentity{name: "provider-key", admin: true, limits: st.config.RateLimits}, true
+			}
+		}
+	}
+
+	log.Printf("Invalid API key provided")
+	http.Error(w, "Invalid API key", http.StatusUnauthorized)
+	return nil, false
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuthenticate(t *testing.T) {
+	clients := []ClientConfig{
+		{Name: "alice", Key: "sk-proxy-alice"},
+		{Name: "bob", Key: "sk-proxy-bob", Disabled: true},
+	}
+	onlyDisabled := []ClientConfig{{Name: "bob", Key: "sk-proxy-bob", Disabled: true}}
+
+	tests := []struct {
+		name         string
+		clients      []ClientConfig
+		providerKeys []string
+		token        string
+		want         string // client name, empty when rejected
+	}{
+		{"enabled key", clients, nil, "sk-proxy-alice", "alice"},
+		{"disabled key", clients, nil, "sk-proxy-bob", ""},
+		{"provider key with client keys", clients, []string{"sk-upstream"}, "sk-upstream", ""},
+		{"no header with client keys", clients, nil, "", ""},
+		{"all keys disabled, no header", onlyDisabled, nil, "", ""},
+		{"all keys disabled, provider key", onlyDisabled, []string{"sk-upstream"}, "sk-upstream", ""},
+		{"provider key fallback", nil, []string{"sk-upstream"}, "sk-upstream", "provider-key"},
+		{"no keys at all", nil, nil, "", "anonymous"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			enabled, err := validateClients(tt.clients, tt.providerKeys)
+			if err != nil {
+				t.Fatal(err)
+			}
+			st := &proxyState{
+				config:       defaultConfig(),
+				clients:      enabled,
+				clientKeys:   len(tt.clients) > 0,
+				providerKeys: tt.providerKeys,
+			}
+
+			r := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			w := httptest.NewRecorder()
+			client, ok := st.authenticate(w, r)
+
+			switch {
+			case tt.want == "" && ok:
+				t.Errorf("accepted as %s, want rejected", client.name)
+			case tt.want == "" && w.Code != http.StatusUnauthorized:
+				t.Errorf("status %d, want %d", w.Code, http.StatusUnauthorized)
+			case tt.want != "" && !ok:
+				t.Errorf("rejected, want %s", tt.want)
+			case tt.want != "" && client.name != tt.want:
+				t.Errorf("accepted as %s, want %s", client.name, tt.want)
+			}
+		})
+	}
+}
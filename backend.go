@@ -0,0 +1,133 @@
+package main
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/andybalholm/brotli"
+	"golang.org/x/net/http2"
+)
+
+// Backend is an upstream provider that chat completions can be forwarded to.
+// Each implementation translates the OpenAI-compatible request into its own
+// wire format and translates the upstream answer back.
+type Backend interface {
+	// Name identifies the backend, e.g. "deepseek".
+	Name() string
+
+	// DefaultModel is the upstream model used when nothing else is selected.
+	DefaultModel() string
+
+	// Models lists the models advertised on /v1/models.
+	Models() []Model
+
+	// NeedsImageData reports whether images given as http(s) URLs must be
+	// downloaded first because the upstream only takes the image data.
+	NeedsImageData() bool
+
+	// NativeToolChoice reports whether the upstream honours "required" and
+	// forced functions in tool_choice. The proxy emulates them otherwise.
+	NativeToolChoice() bool
+
+	// TranslateRequest builds the upstream request body for the given model.
+	// The translation it returns is passed on to translate the answer.
+	TranslateRequest(chatReq *ChatRequest, model string) ([]byte, translation, error)
+
+	// Send forwards the translated body to the upstream API.
+	Send(ctx context.Context, r *http.Request, body []byte, stream bool) (*http.Response, error)
+
+	// TranslateResponse converts a non-streaming upstream body into an
+	// OpenAI chat.completion reporting originalModel.
+	TranslateResponse(body []byte, tr translation, originalModel string) ([]byte, error)
+
+	// TranslateStream returns the upstream stream as OpenAI SSE chunks
+	// reporting originalModel.
+	TranslateStream(resp *http.Response, tr translation, originalModel string) streamSource
+}
+
+// translation is what a backend decided while translating a request that
+// the translation of the answer depends on.
+type translation struct {
+	// Tools were described in the system prompt instead of sent natively,
+	// so tool calls come back as text
+	emulateTools bool
+}
+
+// backendFactories builds a backend from its config, keyed by the name used
+// in Config.Backends.
+var backendFactories = map[string]func(BackendConfig) (Backend, error){
+	"deepseek":   newDeepSeekBackend,
+	"openrouter": newOpenRouterBackend,
+	"ollama":     newOllamaBackend,
+}
+
+// applyDefaults fills in the backend's default sampling parameters for the
+// ones the client did not send. The temperature is a pointer so that an
+// explicit 0 is sent rather than omitted.
+func (bc BackendConfig) applyDefaults(temperature **float64, maxTokens *int, chatReq *ChatRequest) {
+	if chatReq.Temperature != nil {
+		*temperature = chatReq.Temperature
+	} else if bc.Temperature != nil {
+		*temperature = bc.Temperature
+	}
+
+	if chatReq.MaxTokens != nil {
+		*maxTokens = *chatReq.MaxTokens
+	} else if bc.MaxTokens != nil {
+		*maxTokens = *bc.MaxTokens
+	}
+}
+
+// newHTTP2Client returns the client used for HTTPS upstreams.
+func newHTTP2Client() *http.Client {
+	return &http.Client{
+		Transport: &http2.Transport{
+			AllowHTTP: true,
+			DialTLS:   nil,
+		},
+		// Timeouts are handled per request via the context
+		Timeout: 0,
+	}
+}
+
+func copyHeaders(dst, src http.Header) {
+	// Headers to skip
+	skipHeaders := map[string]bool{
+		"Content-Length":    true,
+		"Content-Encoding":  true,
+		"Transfer-Encoding": true,
+		"Connection":        true,
+	}
+
+	for k, vv := range src {
+		if !skipHeaders[k] {
+			for _, v := range vv {
+				dst.Add(k, v)
+			}
+		}
+	}
+}
+
+func readResponse(resp *http.Response) ([]byte, error) {
+	var reader io.Reader = resp.Body
+
+	switch resp.Header.Get("Content-Encoding") {
+	case "gzip":
+		gzReader, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("error creating gzip reader: %v", err)
+		}
+		defer gzReader.Close()
+		reader = gzReader
+	case "br":
+		reader = brotli.NewReader(resp.Body)
+	case "deflate":
+		reader = flate.NewReader(resp.Body)
+	}
+
+	return io.ReadAll(reader)
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Upstream streaming modes of a backend
+const (
+	streamAuto   = "auto"   // stream when the client does
+	streamNever  = "never"  // fetch complete answers, replayed as SSE to streaming clients
+	streamAlways = "always" // stream, aggregated for non-streaming clients
+)
+
+func validateStreamMode(mode string) error {
+	switch mode {
+	case "", streamAuto, streamNever, streamAlways:
+		return nil
+	}
+	return fmt.Errorf("invalid stream mode %q, expected auto, never or always", mode)
+}
+
+// upstreamStream reports whether the upstream request should stream when the
+// client's request does or does not.
+func (bc BackendConfig) upstreamStream(clientStream bool) bool {
+	switch bc.Stream {
+	case streamNever:
+		return false
+	case streamAlways:
+		return true
+	}
+	return clientStream
+}
+
+// planStreams decides for each target whether its upstream request streams.
+func (st *proxyState) planStreams(targets []upstreamTarget, clientStream bool) {
+	for i := range targets {
+		targets[i].stream = st.config.Backends[targets[i].backend.Name()].upstreamStream(clientStream)
+	}
+}
+
+// chatCompletion is an OpenAI chat.completion, as bridged between streaming
+// and non-streaming answers.
+type chatCompletion struct {
+	ID                string             `json:"id"`
+	Object            string             `json:"object"`
+	Created           int64              `json:"created"`
+	Model             string             `json:"model"`
+	SystemFingerprint string             `json:"system_fingerprint,omitempty"`
+	Choices           []completionChoice `json:"choices"`
+	Usage             *Usage             `json:"usage,omitempty"`
+}
+
+type completionChoice struct {
+	Index        int     `json:"index"`
+	Message      Message `json:"message"`
+	FinishReason string  `json:"finish_reason"`
+}
+
+// completionSource replays a non-streaming answer as a stream. The upstream
+// body is read on the first call to next, inside the stream loop, so its
+// timeouts apply.
+type completionSource struct {
+	target        upstreamTarget
+	resp          *http.Response
+	originalModel string
+	events        []*sseEvent
+	read          bool
+}
+
+func newCompletionSource(target upstreamTarget, resp *http.Response, originalModel string) *completionSource {
+	return &completionSource{target: target, resp: resp, originalModel: originalModel}
+}
+
+func (s *completionSource) next() (*sseEvent, error) {
+	if !s.read {
+		s.read = true
+		body, err := readResponse(s.resp)
+		if err != nil {
+			return nil, err
+		}
+		backend := s.target.backend
+		translated, err := backend.TranslateResponse(body, s.target.translation, s.originalModel)
+		if err != nil {
+			return nil, fmt.Errorf("error translating %s response: %v", backend.Name(), err)
+		}
+		var completion chatCompletion
+		if err := json.Unmarshal(translated, &completion); err != nil {
+			return nil, fmt.Errorf("error parsing %s response: %v", backend.Name(), err)
+		}
+		s.events = completionChunks(&completion)
+	}
+
+	if len(s.events) == 0 {
+		return nil, io.EOF
+	}
+	ev := s.events[0]
+	s.events = s.events[1:]
+	return ev, nil
+}
+
+// completionChunks splits a completion into the chunks of a stream: the
+// message of each choice, its finish reason and a usage chunk.
+func completionChunks(completion *chatCompletion) []*sseEvent {
+	chunk := func(choices []map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"id":      completion.ID,
+			"object":  "chat.completion.chunk",
+			"created": completion.Created,
+			"model":   completion.Model,
+			"choices": choices,
+		}
+		if completion.SystemFingerprint != "" {
+			c["system_fingerprint"] = completion.SystemFingerprint
+		}
+		return c
+	}
+
+	var chunks []map[string]interface{}
+	for _, choice := range completion.Choices {
+		delta := map[string]interface{}{
+			"role":    "assistant",
+			"content": choice.Message.Content,
+		}
+		if choice.Message.ReasoningContent != "" {
+			delta["reasoning_content"] = choice.Message.ReasoningContent
+		}
+		if len(choice.Message.ToolCalls) > 0 {
+			delta["tool_calls"] = toolCallDeltas(choice.Message.ToolCalls, 0)
+		}
+
+		chunks = append(chunks,
+			chunk([]map[string]interface{}{
+				{"index": choice.Index, "delta": delta, "finish_reason": nil},
+			}),
+			chunk([]map[string]interface{}{
+				{"index": choice.Index, "delta": map[string]interface{}{}, "finish_reason": choice.FinishReason},
+			}),
+		)
+	}
+
+	var events []*sseEvent
+	for _, c := range chunks {
+		data, _ := json.Marshal(c)
+		events = append(events, &sseEvent{data: data, hasData: true})
+	}
+	if completion.Usage != nil {
+		events = append(events, newUsageChunk(completion.ID, completion.Created, completion.Model, completion.Usage))
+	}
+	return events
+}
+
+// toolCallDeltas returns complete tool calls in the indexed form of stream
+// deltas, numbered from first.
+func toolCallDeltas(calls []ToolCall, first int) []map[string]interface{} {
+	deltas := make([]map[string]interface{}, len(calls))
+	for i, tc := range calls {
+		deltas[i] = map[string]interface{}{
+			"index":    first + i,
+			"id":       tc.ID,
+			"type":     tc.Type,
+			"function": tc.Function,
+		}
+	}
+	return deltas
+}
+
+// aggregateStream reads a translated stream to the end and joins its chunks
+// into one chat.completion.
+func aggregateStream(src streamSource) ([]byte, error) {
+	var agg completionAggregator
+	for {
+		ev, err := src.next()
+		if err == io.EOF || (err == nil && ev.isDone()) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if ev.hasData {
+			agg.add(ev.data)
+		}
+	}
+
+	completion := agg.completion()
+	if len(completion.Choices) == 0 {
+		return nil, fmt.Errorf("upstream stream contained no choices")
+	}
+	return json.Marshal(completion)
+}
+
+// completionAggregator joins chat.completion.chunk events into the
+// chat.completion they add up to.
+type completionAggregator struct {
+	head      chatCompletion
+	choices   []*completionChoice
+	content   []*strings.Builder
+	reasoning []*strings.Builder
+	args      [][]*strings.Builder
+}
+
+// add folds the data of one chunk into the completion. Data that is not a
+// chunk is ignored.
+func (a *completionAggregator) add(data []byte) {
+	var chunk struct {
+		ID                string `json:"id"`
+		Created           int64  `json:"created"`
+		Model             string `json:"model"`
+		SystemFingerprint string `json:"system_fingerprint"`
+		Choices           []struct {
+			Index int `json:"index"`
+			Delta struct {
+				Content          string `json:"content"`
+				ReasoningContent string `json:"reasoning_content"`
+				ToolCalls        []struct {
+					Index    int    `json:"index"`
+					ID       string `json:"id"`
+					Type     string `json:"type"`
+					Function struct {
+						Name      string `json:"name"`
+						Arguments string `json:"arguments"`
+					} `json:"function"`
+				} `json:"tool_calls"`
+			} `json:"delta"`
+			FinishReason *string `json:"finish_reason"`
+		} `json:"choices"`
+		Usage *Usage `json:"usage"`
+	}
+	if err := json.Unmarshal(data, &chunk); err != nil {
+		return
+	}
+	if a.head.ID == "" {
+		a.head.ID, a.head.Created = chunk.ID, chunk.Created
+	}
+	if chunk.Model != "" {
+		a.head.Model = chunk.Model
+	}
+	if chunk.SystemFingerprint != "" {
+		a.head.SystemFingerprint = chunk.SystemFingerprint
+	}
+	if chunk.Usage != nil {
+		a.head.Usage = chunk.Usage
+	}
+
+	for _, c := range chunk.Choices {
+		if c.Index < 0 {
+			continue
+		}
+		for len(a.choices) <= c.Index {
+			a.choices = append(a.choices, &completionChoice{Index: len(a.choices), Message: Message{Role: "assistant"}})
+			a.content = append(a.content, &strings.Builder{})
+			a.reasoning = append(a.reasoning, &strings.Builder{})
+			a.args = append(a.args, nil)
+		}
+		choice := a.choices[c.Index]
+		a.content[c.Index].WriteString(c.Delta.Content)
+		a.reasoning[c.Index].WriteString(c.Delta.ReasoningContent)
+
+		// Tool calls arrive in pieces: the first carries the id and name,
+		// the rest append to the arguments
+		for _, tc := range c.Delta.ToolCalls {
+			if tc.Index < 0 {
+				continue
+			}
+			for len(choice.Message.ToolCalls) <= tc.Index {
+				choice.Message.ToolCalls = append(choice.Message.ToolCalls, ToolCall{Type: "function"})
+				a.args[c.Index] = append(a.args[c.Index], &strings.Builder{})
+			}
+			call := &choice.Message.ToolCalls[tc.Index]
+			if tc.ID != "" {
+				call.ID = tc.ID
+			}
+			if tc.Type != "" {
+				call.Type = tc.Type
+			}
+			call.Function.Name += tc.Function.Name
+			a.args[c.Index][tc.Index].WriteString(tc.Function.Arguments)
+		}
+
+		if c.FinishReason != nil && *c.FinishReason != "" {
+			choice.FinishReason = *c.FinishReason
+		}
+	}
+}
+
+// completion returns the completion of the chunks added so far.
+func (a *completionAggregator) completion() *chatCompletion {
+	completion := a.head
+	completion.Object = "chat.completion"
+	completion.Choices = nil
+	for i, choice := range a.choices {
+		c := *choice
+		c.Message.Content = a.content[i].String()
+		c.Message.ReasoningContent = a.reasoning[i].String()
+		c.Message.ToolCalls = append([]ToolCall(nil), choice.Message.ToolCalls...)
+		for j := range c.Message.ToolCalls {
+			c.Message.ToolCalls[j].Function.Arguments = a.args[i][j].String()
+		}
+		completion.Choices = append(completion.Choices, c)
+	}
+	return &completion
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// summarize writes the parts of a completion the aggregator builds, one
+// choice per line.
+func summarize(c *chatCompletion) string {
+	var lines []string
+	for _, choice := range c.Choices {
+		line := fmt.Sprintf("%d %q %q %s", choice.Index, choice.Message.Content, choice.Message.ReasoningContent, choice.FinishReason)
+		for _, call := range choice.Message.ToolCalls {
+			line += fmt.Sprintf(" %s:%s(%s)", call.ID, call.Function.Name, call.Function.Arguments)
+		}
+		lines = append(lines, line)
+	}
+	if c.Usage != nil {
+		lines = append(lines, fmt.Sprintf("usage %d+%d", c.Usage.PromptTokens, c.Usage.CompletionTokens))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func TestCompletionAggregator(t *testing.T) {
+	tests := []struct {
+		name   string
+		chunks []string
+		want   string
+	}{
+		{
+			name: "content and reasoning",
+			chunks: []string{
+				`{"id":"a","choices":[{"index":0,"delta":{"role":"assistant","reasoning_content":"Let me "}}]}`,
+				`{"id":"b","choices":[{"index":0,"delta":{"reasoning_content":"think."}}]}`,
+				`{"choices":[{"index":0,"delta":{"content":"Hel"}}]}`,
+				`{"choices":[{"index":0,"delta":{"content":"lo"},"finish_reason":null}]}`,
+				`{"choices":[{"index":0,"delta":{},"finish_reason":"stop"}]}`,
+			},
+			want: `0 "Hello" "Let me think." stop`,
+		},
+		{
+			name: "tool call arguments split across chunks",
+			chunks: []string{
+				`{"choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"id":"call_1","type":"function","function":{"name":"search","arguments":""}}]}}]}`,
+				`{"choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"{\"q\":"}}]}}]}`,
+				`{"choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"\"x\"}"}}]}}]}`,
+				`{"choices":[{"index":0,"delta":{},"finish_reason":"tool_calls"}]}`,
+			},
+			want: `0 "" "" tool_calls call_1:search({"q":"x"})`,
+		},
+		{
+			name: "parallel tool calls interleaved",
+			chunks: []string{
+				`{"choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"id":"call_1","function":{"name":"a","arguments":"{"}},{"index":1,"id":"call_2","function":{"name":"b","arguments":"["}}]}}]}`,
+				`{"choices":[{"index":0,"delta":{"tool_calls":[{"index":1,"function":{"arguments":"]"}}]}}]}`,
+				`{"choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"}"}}]},"finish_reason":"tool_calls"}]}`,
+			},
+			want: `0 "" "" tool_calls call_1:a({}) call_2:b([])`,
+		},
+		{
+			name: "several choices",
+			chunks: []string{
+				`{"choices":[{"index":1,"delta":{"content":"B"}}]}`,
+				`{"choices":[{"index":0,"delta":{"content":"A"}},{"index":1,"delta":{"content":"b"}}]}`,
+				`{"choices":[{"index":0,"delta":{},"finish_reason":"stop"},{"index":1,"delta":{},"finish_reason":"length"}]}`,
+			},
+			want: "0 \"A\" \"\" stop\n1 \"Bb\" \"\" length",
+		},
+		{
+			name: "usage-only chunk",
+			chunks: []string{
+				`{"choices":[{"index":0,"delta":{"content":"Hi"},"finish_reason":"stop"}]}`,
+				`{"choices":[],"usage":{"prompt_tokens":10,"completion_tokens":2,"total_tokens":12}}`,
+			},
+			want: "0 \"Hi\" \"\" stop\nusage 10+2",
+		},
+		{
+			name: "data that is not a chunk",
+			chunks: []string{
+				`not json`,
+				`{"choices":[{"index":-1,"delta":{"content":"x"}}]}`,
+				`{"choices":[{"index":0,"delta":{"content":"ok"},"finish_reason":"stop"}]}`,
+			},
+			want: `0 "ok" "" stop`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var agg completionAggregator
+			for _, chunk := range tt.chunks {
+				agg.add([]byte(chunk))
+			}
+			if got := summarize(agg.completion()); got != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompletionAggregatorHead(t *testing.T) {
+	var agg completionAggregator
+	agg.add([]byte(`{"id":"first","created":1,"model":"m1","choices":[]}`))
+	agg.add([]byte(`{"id":"second","created":2,"model":"m2","system_fingerprint":"fp","choices":[]}`))
+	c := agg.completion()
+	if c.ID != "first" || c.Created != 1 || c.Model != "m2" || c.SystemFingerprint != "fp" || c.Object != "chat.completion" {
+		t.Errorf("head = %+v", c)
+	}
+}
+
+// A completion split into chunks and joined again is the same completion.
+func TestCompletionChunksRoundTrip(t *testing.T) {
+	completion := &chatCompletion{
+		ID:      "chatcmpl-1",
+		Created: 1,
+		Model:   "deepseek-chat",
+		Choices: []completionChoice{
+			{Index: 0, Message: Message{Role: "assistant", Content: "Hi", ReasoningContent: "hmm"}, FinishReason: "stop"},
+			{Index: 1, Message: Message{Role: "assistant", ToolCalls: []ToolCall{{ID: "call_1", Type: "function"}}}, FinishReason: "tool_calls"},
+		},
+		Usage: &Usage{PromptTokens: 3, CompletionTokens: 4, TotalTokens: 7},
+	}
+	completion.Choices[1].Message.ToolCalls[0].Function.Name = "search"
+	completion.Choices[1].Message.ToolCalls[0].Function.Arguments = `{"q":"x"}`
+
+	var agg completionAggregator
+	for _, ev := range completionChunks(completion) {
+		agg.add(ev.data)
+	}
+	if got, want := summarize(agg.completion()), summarize(completion); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	budgetDaily   = "daily"
+	budgetMonthly = "monthly"
+
+	budgetReject  = "reject"
+	budgetReroute = "reroute"
+
+	defaultRerouteTarget = "ollama"
+	budgetWebhookTimeout = 10 * time.Second
+)
+
+// BudgetConfig caps the spend of a client key or backend per calendar day or
+// month (UTC), in the currency of the pricing table. Zero caps are disabled.
+type BudgetConfig struct {
+	Period string  `yaml:"period"` // daily or monthly (default)
+	Soft   float64 `yaml:"soft"`   // warn once per period
+	Hard   float64 `yaml:"hard"`   // stop spending once reached
+
+	// OnHardCap is reject (default) or reroute
+	OnHardCap string `yaml:"on_hard_cap"`
+
+	// RerouteTo is the "backend" or "backend:model" target rerouted requests
+	// go to, ollama by default
+	RerouteTo string `yaml:"reroute_to"`
+}
+
+// BudgetsConfig holds the settings shared by all budgets.
+type BudgetsConfig struct {
+	// Webhook receives a JSON POST when a budget crosses a cap
+	Webhook string `yaml:"webhook"`
+
+	// Clients is the budget of every client key without its own
+	Clients *BudgetConfig `yaml:"clients"`
+}
+
+func (b *BudgetConfig) validate(backends map[string]Backend) error {
+	if b == nil {
+		return nil
+	}
+	switch b.Period {
+	case "", budgetDaily, budgetMonthly:
+	default:
+		return fmt.Errorf("invalid budget period %q, expected daily or monthly", b.Period)
+	}
+	if b.Soft < 0 || b.Hard < 0 {
+		return fmt.Errorf("budget caps must not be negative")
+	}
+	if b.Soft > 0 && b.Hard > 0 && b.Soft > b.Hard {
+		return fmt.Errorf("soft budget cap is above the hard cap")
+	}
+	switch b.OnHardCap {
+	case "", budgetReject, budgetReroute:
+	default:
+		return fmt.Errorf("invalid on_hard_cap %q, expected reject or reroute", b.OnHardCap)
+	}
+	target, err := parseRouteTarget(b.rerouteTarget())
+	if err != nil {
+		return fmt.Errorf("reroute_to: %v", err)
+	}
+	if _, ok := backends[target.backend]; !ok && b.OnHardCap == budgetReroute {
+		return fmt.Errorf("reroute_to refers to unknown backend %q", target.backend)
+	}
+	return nil
+}
+
+func (b *BudgetConfig) period() string {
+	if b.Period == "" {
+		return budgetMonthly
+	}
+	return b.Period
+}
+
+func (b *BudgetConfig) rerouteTarget() string {
+	if b.RerouteTo == "" {
+		return defaultRerouteTarget
+	}
+	return b.RerouteTo
+}
+
+// budgetKey identifies the spend of one client or backend in the period
+// containing t.
+func budgetKey(scope, name, period string, t time.Time) string {
+	t = t.UTC()
+	if period == budgetDaily {
+		return scope + "/" + name + "/" + t.Format("2006-01-02")
+	}
+	return scope + "/" + name + "/" + t.Format("2006-01")
+}
+
+// spendTracker sums the cost of the ledger records per client and backend.
+// It is seeded from the ledger so budgets survive restarts, and like the rate
+// limiters it outlives config reloads.
+type spendTracker struct {
+	mu       sync.Mutex
+	ledger   string // path the totals were read from
+	loaded   bool
+	spend    map[string]float64
+	notified map[string]bool // caps already reported this period
+}
+
+var spending = &spendTracker{}
+
+// load reads the totals from the ledger at path unless they were already
+// read from there.
+func (s *spendTracker) load(path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.loaded && s.ledger == path {
+		return nil
+	}
+
+	s.ledger = path
+	s.loaded = true
+	s.spend = map[string]float64{}
+	s.notified = map[string]bool{}
+	return readLedger(path, s.addLocked)
+}
+
+func (s *spendTracker) add(rec UsageRecord) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.spend == nil {
+		s.spend = map[string]float64{}
+		s.notified = map[string]bool{}
+	}
+	s.addLocked(rec)
+}
+
+func (s *spendTracker) addLocked(rec UsageRecord) {
+	if rec.Cost == nil {
+		return
+	}
+	for _, period := range []string{budgetDaily, budgetMonthly} {
+		s.spend[budgetKey("client", rec.Client, period, rec.Time)] += *rec.Cost
+		s.spend[budgetKey("backend", rec.Backend, period, rec.Time)] += *rec.Cost
+	}
+}
+
+func (s *spendTracker) current(scope, name string, budget *BudgetConfig) float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.spend[budgetKey(scope, name, budget.period(), time.Now())]
+}
+
+// budgetStatus describes the spend of one client or backend against its
+// budget.
+type budgetStatus struct {
+	scope  string // client or backend
+	name   string
+	budget *BudgetConfig
+	spend  float64
+}
+
+func (bs budgetStatus) exhausted() bool {
+	return bs.budget.Hard > 0 && bs.spend >= bs.budget.Hard
+}
+
+func (bs budgetStatus) message() string {
+	retry := "next month"
+	if bs.budget.period() == budgetDaily {
+		retry = "tomorrow"
+	}
+	return fmt.Sprintf("You exceeded the %s budget of %s %s: spent %.4f of %.4f. Please try again %s.",
+		bs.budget.period(), bs.scope, bs.name, bs.spend, bs.budget.Hard, retry)
+}
+
+func (st *proxyState) budgetStatus(scope, name string) (budgetStatus, bool) {
+	var budget *BudgetConfig
+	switch scope {
+	case "client":
+		budget = st.config.Budgets.Clients
+		for _, c := range st.clients {
+			if c.Name == name && c.Budget != nil {
+				budget = c.Budget
+			}
+		}
+	case "backend":
+		budget = st.config.Backends[name].Budget
+	}
+	if budget == nil {
+		return budgetStatus{}, false
+	}
+	return budgetStatus{
+		scope:  scope,
+		name:   name,
+		budget: budget,
+		spend:  spending.current(scope, name, budget),
+	}, true
+}
+
+// applyBudgets enforces the hard caps of the client and of the targets'
+// backends. Exhausted targets are dropped or replaced by their budget's
+// reroute target; an error is returned when nothing is left to try.
+func (st *proxyState) applyBudgets(client *clientIdentity, targets []upstreamTarget) ([]upstreamTarget, *budgetStatus) {
+	if bs, ok := st.budgetStatus("client", client.name); ok && bs.exhausted() {
+		if bs.budget.OnHardCap != budgetReroute {
+			return nil, &bs
+		}
+		log.Printf("Client %s is over budget, rerouting to %s", client.name, bs.budget.rerouteTarget())
+		return []upstreamTarget{st.reroute(bs.budget)}, nil
+	}
+
+	var allowed []upstreamTarget
+	var exhausted *budgetStatus
+	seen := map[upstreamTarget]bool{}
+	for _, target := range targets {
+		bs, ok := st.budgetStatus("backend", target.backend.Name())
+		if ok && bs.exhausted() {
+			exhausted = &bs
+			if bs.budget.OnHardCap != budgetReroute {
+				log.Printf("Backend %s is over budget, skipping it", target.backend.Name())
+				continue
+			}
+			log.Printf("Backend %s is over budget, rerouting to %s", target.backend.Name(), bs.budget.rerouteTarget())
+			target = st.reroute(bs.budget)
+		}
+		if !seen[target] {
+			seen[target] = true
+			allowed = append(allowed, target)
+		}
+	}
+	if len(allowed) == 0 {
+		return nil, exhausted
+	}
+	return allowed, nil
+}
+
+// reroute resolves the target over-budget requests are sent to instead.
+func (st *proxyState) reroute(budget *BudgetConfig) upstreamTarget {
+	// Already checked by validate
+	target, _ := parseRouteTarget(budget.rerouteTarget())
+	return st.router.resolve(target)
+}
+
+// checkBudgetCaps reports caps crossed by the spend recorded in rec, once per
+// cap and period.
+func (st *proxyState) checkBudgetCaps(rec UsageRecord) {
+	for _, scope := range []struct{ scope, name string }{{"client", rec.Client}, {"backend", rec.Backend}} {
+		bs, ok := st.budgetStatus(scope.scope, scope.name)
+		if !ok {
+			continue
+		}
+		for _, c := range []struct {
+			kind string
+			cap  float64
+		}{{"soft", bs.budget.Soft}, {"hard", bs.budget.Hard}} {
+			event := c.kind + "_cap"
+			if c.cap <= 0 || bs.spend < c.cap || !spending.markNotified(bs, event) {
+				continue
+			}
+			log.Printf("Warning: %s %s reached the %s cap of its %s budget: spent %.4f of %.4f", bs.scope, bs.name, c.kind, bs.budget.period(), bs.spend, c.cap)
+			if st.config.Budgets.Webhook != "" {
+				go notifyBudgetWebhook(st.config.Budgets.Webhook, bs, event, c.cap)
+			}
+		}
+	}
+}
+
+// markNotified returns true the first time event is reported for bs in the
+// current period.
+func (s *spendTracker) markNotified(bs budgetStatus, event string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := budgetKey(bs.scope, bs.name, bs.budget.period(), time.Now()) + "/" + event
+	if s.notified[key] {
+		return false
+	}
+	s.notified[key] = true
+	return true
+}
+
+// budgetEvent is the JSON body posted to the budget webhook
+type budgetEvent struct {
+	Event  string    `json:"event"` // soft_cap or hard_cap
+	Scope  string    `json:"scope"` // client or backend
+	Name   string    `json:"name"`
+	Period string    `json:"period"`
+	Spend  float64   `json:"spend"`
+	Cap    float64   `json:"cap"`
+	Time   time.Time `json:"time"`
+}
+
+func notifyBudgetWebhook(url string, bs budgetStatus, event string, limit float64) {
+	body, err := json.Marshal(budgetEvent{
+		Event:  event,
+		Scope:  bs.scope,
+		Name:   bs.name,
+		Period: bs.budget.period(),
+		Spend:  bs.spend,
+		Cap:    limit,
+		Time:   time.Now().UTC(),
+	})
+	if err != nil {
+		log.Printf("Error encoding budget webhook: %v", err)
+		return
+	}
+
+	client := &http.Client{Timeout: budgetWebhookTimeout}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("Error calling budget webhook: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Printf("Budget webhook returned status %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// cacheControlHeader lets clients opt in to (or out of) the response
+	// cache for a request, e.g. "X-Proxy-Cache: true"
+	cacheControlHeader = "X-Proxy-Cache"
+	cacheStatusHeader  = "X-Cache"
+
+	defaultCacheTTL        = time.Hour
+	defaultCacheMaxEntries = 1000
+	defaultCacheMaxBytes   = 64 << 20
+)
+
+// CacheConfig configures the response cache for deterministic requests.
+// Zero limits mean unlimited.
+type CacheConfig struct {
+	Enabled    bool          `yaml:"enabled"`
+	TTL        time.Duration `yaml:"ttl"`
+	MaxEntries int           `yaml:"max_entries"`
+	MaxBytes   int64         `yaml:"max_bytes"`
+
+	// ReplayInterval paces the chunks of a cached stream
+	ReplayInterval time.Duration `yaml:"replay_interval"`
+}
+
+func (c CacheConfig) validate() error {
+	if c.TTL < 0 || c.MaxEntries < 0 || c.MaxBytes < 0 || c.ReplayInterval < 0 {
+		return errors.New("cache limits must not be negative")
+	}
+	return nil
+}
+
+// wantsCache reports whether the response to chatReq may be cached and served
+// from the cache. Requests with temperature 0 are cached unless the client
+// opts out with the cache header; others only when it opts in.
+func wantsCache(r *http.Request, chatReq *ChatRequest) bool {
+	if v := r.Header.Get(cacheControlHeader); v != "" {
+		enabled, err := strconv.ParseBool(v)
+		return err == nil && enabled
+	}
+	return chatReq.Temperature != nil && *chatReq.Temperature == 0
+}
+
+// responseCacheKey hashes everything that determines the answer: the request
+// as the proxy understood it and the upstream targets it resolves to.
+func responseCacheKey(chatReq *ChatRequest, targets []upstreamTarget) string {
+	names := make([]string, len(targets))
+	for i, t := range targets {
+		names[i] = t.backend.Name() + ":" + t.model
+	}
+
+	// Struct fields marshal in a fixed order and map keys sorted, so equal
+	// requests hash equally regardless of how the client formatted them
+	data, err := json.Marshal(struct {
+		Request *ChatRequest `json:"request"`
+		Targets []string     `json:"targets"`
+	}{chatReq, names})
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// cacheEntry is one cached, already translated response: the body of a
+// regular response or the chunk data of a stream.
+type cacheEntry struct {
+	key          string
+	body         []byte
+	chunks       [][]byte
+	backend      string // backend and model that produced it
+	model        string
+	finishReason string
+	expires      time.Time
+}
+
+func (e *cacheEntry) size() int64 {
+	size := len(e.key) + len(e.body)
+	for _, chunk := range e.chunks {
+		size += len(chunk)
+	}
+	return int64(size)
+}
+
+// responseCache is an LRU cache with a TTL and entry and byte limits. Like
+// the rate limiters it outlives config reloads.
+type responseCache struct {
+	mu      sync.Mutex
+	config  CacheConfig
+	entries map[string]*list.Element
+	lru     *list.List // most recently used at the front
+	size    int64
+}
+
+var responses = &responseCache{
+	entries: map[string]*list.Element{},
+	lru:     list.New(),
+}
+
+// configure applies new limits, evicting entries that no longer fit.
+func (c *responseCache) configure(cfg CacheConfig) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.config = cfg
+	if !cfg.Enabled {
+		c.entries = map[string]*list.Element{}
+		c.lru.Init()
+		c.size = 0
+		return
+	}
+	c.evict()
+}
+
+func (c *responseCache) get(key string) (*cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := el.Value.(*cacheEntry)
+	if !entry.expires.IsZero() && time.Now().After(entry.expires) {
+		c.remove(el)
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	return entry, true
+}
+
+func (c *responseCache) put(entry *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.config.Enabled || (c.config.MaxBytes > 0 && entry.size() > c.config.MaxBytes) {
+		return
+	}
+	if el, ok := c.entries[entry.key]; ok {
+		c.remove(el)
+	}
+	if c.config.TTL > 0 {
+		entry.expires = time.Now().Add(c.config.TTL)
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	c.size += entry.size()
+	c.evict()
+}
+
+// evict drops the least recently used entries until the limits are met.
+func (c *responseCache) evict() {
+	for c.lru.Len() > 0 && ((c.config.MaxEntries > 0 && c.lru.Len() > c.config.MaxEntries) ||
+		(c.config.MaxBytes > 0 && c.size > c.config.MaxBytes)) {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *responseCache) remove(el *list.Element) {
+	entry := c.lru.Remove(el).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.size -= entry.size()
+}
+
+// serveCachedResponse answers a request from the cache.
+func serveCachedResponse(w http.ResponseWriter, entry *cacheEntry) {
+	log.Printf("Serving cached response from %s:%s", entry.backend, entry.model)
+	w.Header().Set(cacheStatusHeader, "HIT")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(entry.body)
+}
+
+// replayCachedStream answers a streaming request from the cache, sending the
+// recorded chunks as server-sent events paced by interval.
+func replayCachedStream(w http.ResponseWriter, r *http.Request, entry *cacheEntry, interval time.Duration) {
+	log.Printf("Replaying cached stream from %s:%s (%d chunks)", entry.backend, entry.model, len(entry.chunks))
+	w.Header().Set(cacheStatusHeader, "HIT")
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	flusher, _ := w.(http.Flusher)
+	for i, chunk := range entry.chunks {
+		if i > 0 && interval > 0 {
+			select {
+			case <-time.After(interval):
+			case <-r.Context().Done():
+				log.Printf("Client disconnected during cached stream replay")
+				return
+			}
+		}
+		if _, err := fmt.Fprintf(w, "data: %s\n\n", chunk); err != nil {
+			log.Printf("Error writing cached chunk: %v", err)
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	fmt.Fprint(w, "data: [DONE]\n\n")
+	if flusher != nil {
+		flusher.Flush()
+	}
+}
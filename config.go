@@ -0,0 +1,452 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	defaultConfigPath     = "config.yaml"
+	defaultListenAddr     = ":9000"
+	configPollInterval    = 2 * time.Second
+	defaultRequestTimeout = 5 * time.Minute
+)
+
+// Config is the declarative proxy configuration loaded from the YAML config
+// file, with environment variables and command line flags layered on top.
+type Config struct {
+	Listen         string                   `yaml:"listen"`
+	DefaultBackend string                   `yaml:"default_backend"`
+	Backends       map[string]BackendConfig `yaml:"backends"`
+	Routes         []RouteConfig            `yaml:"routes"`
+	Clients        []ClientConfig           `yaml:"clients"`
+	RateLimits     RateLimitConfig          `yaml:"rate_limits"`
+	Ledger         LedgerConfig             `yaml:"ledger"`
+	Pricing        map[string]ModelPrice    `yaml:"pricing"`
+	Budgets        BudgetsConfig            `yaml:"budgets"`
+	Cache          CacheConfig              `yaml:"cache"`
+	Timeouts       TimeoutConfig            `yaml:"timeouts"`
+	Resume         ResumeConfig             `yaml:"resume"`
+	Images         ImageConfig              `yaml:"images"`
+}
+
+// BackendConfig configures one upstream provider. The map key in
+// Config.Backends selects the implementation.
+type BackendConfig struct {
+	Endpoint string `yaml:"endpoint"`
+	APIKey   string `yaml:"api_key"`
+	Model    string `yaml:"model"`
+
+	// Defaults applied when the client does not send the parameter
+	Temperature *float64 `yaml:"temperature"`
+	MaxTokens   *int     `yaml:"max_tokens"`
+
+	// Budget caps the spend on this backend across all clients
+	Budget *BudgetConfig `yaml:"budget"`
+
+	// Reasoning is drop, think or passthrough (default) and controls how
+	// the reasoning of reasoning models reaches the client
+	Reasoning string `yaml:"reasoning"`
+
+	// Stream is auto (default), never or always and decides whether the
+	// upstream request streams, independently of the client
+	Stream string `yaml:"stream"`
+
+	// Vision sends image content parts to the backend instead of dropping
+	// them. On by default for OpenRouter and Ollama.
+	Vision *bool `yaml:"vision"`
+
+	// Tools is auto (default), native or prompt and selects whether Ollama
+	// models get tools in the request or described in the system prompt
+	Tools string `yaml:"tools"`
+}
+
+// RouteConfig maps a client model pattern to targets of the form
+// "backend" or "backend:model", tried in order.
+type RouteConfig struct {
+	Model   string   `yaml:"model"`
+	Targets []string `yaml:"targets"`
+}
+
+// TimeoutConfig bounds upstream requests. Zero disables a timeout.
+type TimeoutConfig struct {
+	// Request bounds non-streaming upstream requests
+	Request time.Duration `yaml:"request"`
+
+	// FirstByte bounds the wait for the first event of a stream, Idle the
+	// gap between events and Stream the whole stream
+	FirstByte time.Duration `yaml:"first_byte"`
+	Idle      time.Duration `yaml:"idle"`
+	Stream    time.Duration `yaml:"stream"`
+}
+
+// configFlags holds the command line overrides; empty values are ignored.
+type configFlags struct {
+	path    string
+	listen  string
+	backend string
+	model   string
+	routes  string
+}
+
+// proxyState is everything derived from one version of the config. Requests
+// take a snapshot at the start so a reload never changes them midway.
+type proxyState struct {
+	config       *Config
+	router       *modelRouter
+	clients      []ClientConfig // enabled client keys
+	clientKeys   bool           // client keys are configured, even if all are disabled
+	providerKeys []string
+}
+
+var state atomic.Pointer[proxyState]
+
+func currentState() *proxyState {
+	return state.Load()
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Listen: defaultListenAddr,
+		Backends: map[string]BackendConfig{
+			// Ollama needs no credentials so it is always available
+			"ollama": {},
+		},
+		Ledger: LedgerConfig{
+			Path: defaultLedgerPath,
+		},
+		Timeouts: TimeoutConfig{
+			Request:   defaultRequestTimeout,
+			FirstByte: defaultFirstByteTimeout,
+			Idle:      defaultIdleTimeout,
+			Stream:    defaultStreamTimeout,
+		},
+		Resume: ResumeConfig{
+			Window: defaultResumeWindow,
+		},
+		Cache: CacheConfig{
+			TTL:        defaultCacheTTL,
+			MaxEntries: defaultCacheMaxEntries,
+			MaxBytes:   defaultCacheMaxBytes,
+		},
+	}
+}
+
+// loadConfig reads the config file (if any) and applies environment and flag
+// overrides on top of it. The default config file may only be missing on the
+// initial load: on a reload it is more likely being rewritten, and falling
+// back to the defaults would drop every client key.
+func loadConfig(flags configFlags, initial bool) (*Config, error) {
+	cfg := defaultConfig()
+
+	if flags.path != "" {
+		data, err := os.ReadFile(flags.path)
+		switch {
+		case err == nil:
+			if err := yaml.Unmarshal(data, cfg); err != nil {
+				return nil, fmt.Errorf("error parsing %s: %v", flags.path, err)
+			}
+		case errors.Is(err, os.ErrNotExist) && flags.path == defaultConfigPath && initial:
+			// The default config file is optional
+		default:
+			return nil, fmt.Errorf("error reading config file: %v", err)
+		}
+	}
+
+	applyEnvOverrides(cfg)
+	applyFlagOverrides(cfg, flags)
+
+	return cfg, nil
+}
+
+// setBackendField updates one backend's config, creating the entry if needed.
+func (cfg *Config) setBackendField(name string, set func(*BackendConfig)) {
+	if cfg.Backends == nil {
+		cfg.Backends = map[string]BackendConfig{}
+	}
+	bc := cfg.Backends[name]
+	set(&bc)
+	cfg.Backends[name] = bc
+}
+
+// applyEnvOverrides lets the environment (e.g. a Docker --env-file) override
+// the config file.
+func applyEnvOverrides(cfg *Config) {
+	if v := os.Getenv("LISTEN_ADDR"); v != "" {
+		cfg.Listen = v
+	}
+	if v := os.Getenv("BACKEND"); v != "" {
+		cfg.DefaultBackend = v
+	}
+	if v := os.Getenv("DEEPSEEK_API_KEY"); v != "" {
+		cfg.setBackendField("deepseek", func(bc *BackendConfig) { bc.APIKey = v })
+	}
+	if v := os.Getenv("OPENROUTER_API_KEY"); v != "" {
+		cfg.setBackendField("openrouter", func(bc *BackendConfig) { bc.APIKey = v })
+	}
+	if v := os.Getenv("OLLAMA_API_ENDPOINT"); v != "" {
+		cfg.setBackendField("ollama", func(bc *BackendConfig) { bc.Endpoint = v })
+	}
+	if v := os.Getenv("DEFAULT_MODEL"); v != "" {
+		// Like -model, applies to the default backend
+		cfg.setBackendField(cfg.defaultBackendName(), func(bc *BackendConfig) { bc.Model = v })
+	}
+	if v := os.Getenv("MODEL_ROUTES"); v != "" {
+		cfg.Routes = parseRouteConfigs(v)
+	}
+	if v := os.Getenv("USAGE_LEDGER"); v != "" {
+		cfg.Ledger.Path = v
+	}
+	if v := os.Getenv("CLIENT_KEYS"); v != "" {
+		cfg.Clients = parseClientConfigs(v)
+	}
+}
+
+func applyFlagOverrides(cfg *Config, flags configFlags) {
+	if flags.listen != "" {
+		cfg.Listen = flags.listen
+	}
+	if flags.backend != "" {
+		cfg.DefaultBackend = flags.backend
+	}
+	if flags.routes != "" {
+		cfg.Routes = parseRouteConfigs(flags.routes)
+	}
+	if flags.model != "" {
+		// The -model flag applies to the default backend
+		name := cfg.defaultBackendName()
+		cfg.setBackendField(name, func(bc *BackendConfig) { bc.Model = flags.model })
+	}
+}
+
+// defaultBackendName returns the configured default backend or, without an
+// explicit choice, the first of deepseek, openrouter and ollama that is
+// configured.
+func (cfg *Config) defaultBackendName() string {
+	if cfg.DefaultBackend != "" {
+		return cfg.DefaultBackend
+	}
+	for _, name := range []string{"deepseek", "openrouter", "ollama"} {
+		if _, ok := cfg.Backends[name]; ok {
+			return name
+		}
+	}
+	return "ollama"
+}
+
+// validate checks the config and builds the state it describes.
+func (cfg *Config) validate() (*proxyState, error) {
+	if cfg.Listen == "" {
+		return nil, errors.New("listen address is required")
+	}
+	if cfg.Timeouts.Request < 0 || cfg.Timeouts.FirstByte < 0 || cfg.Timeouts.Idle < 0 || cfg.Timeouts.Stream < 0 {
+		return nil, errors.New("timeouts must not be negative")
+	}
+	if len(cfg.Backends) == 0 {
+		return nil, errors.New("at least one backend must be configured")
+	}
+	if err := cfg.RateLimits.validate(); err != nil {
+		return nil, err
+	}
+	if err := cfg.Cache.validate(); err != nil {
+		return nil, err
+	}
+	for model, price := range cfg.Pricing {
+		if err := price.validate(); err != nil {
+			return nil, fmt.Errorf("pricing for %s: %v", model, err)
+		}
+	}
+
+	st := &proxyState{config: cfg}
+	built := map[string]Backend{}
+	for name, bc := range cfg.Backends {
+		newBackend, ok := backendFactories[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown backend %q", name)
+		}
+		if err := validateReasoningPolicy(bc.Reasoning); err != nil {
+			return nil, fmt.Errorf("backend %s: %v", name, err)
+		}
+		if err := validateStreamMode(bc.Stream); err != nil {
+			return nil, fmt.Errorf("backend %s: %v", name, err)
+		}
+		backend, err := newBackend(bc)
+		if err != nil {
+			return nil, fmt.Errorf("backend %s: %v", name, err)
+		}
+		built[name] = backend
+		if bc.APIKey != "" {
+			st.providerKeys = append(st.providerKeys, bc.APIKey)
+		}
+	}
+
+	var err error
+	st.clients, err = validateClients(cfg.Clients, st.providerKeys)
+	if err != nil {
+		return nil, err
+	}
+	st.clientKeys = len(cfg.Clients) > 0
+
+	defaultName := cfg.defaultBackendName()
+	if _, ok := built[defaultName]; !ok {
+		return nil, fmt.Errorf("default backend %q is not configured", defaultName)
+	}
+
+	routes, err := cfg.modelRoutes()
+	if err != nil {
+		return nil, err
+	}
+	st.router, err = newModelRouter(built, defaultName, routes)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cfg.Budgets.Clients.validate(built); err != nil {
+		return nil, fmt.Errorf("budgets.clients: %v", err)
+	}
+	for _, c := range cfg.Clients {
+		if err := c.Budget.validate(built); err != nil {
+			return nil, fmt.Errorf("client %s budget: %v", c.Name, err)
+		}
+	}
+	for name, bc := range cfg.Backends {
+		if err := bc.Budget.validate(built); err != nil {
+			return nil, fmt.Errorf("backend %s budget: %v", name, err)
+		}
+	}
+
+	return st, nil
+}
+
+func (cfg *Config) modelRoutes() ([]modelRoute, error) {
+	routes := make([]modelRoute, 0, len(cfg.Routes))
+	for _, rc := range cfg.Routes {
+		if rc.Model == "" {
+			return nil, errors.New("route without model pattern")
+		}
+		if len(rc.Targets) == 0 {
+			return nil, fmt.Errorf("route %s has no targets", rc.Model)
+		}
+
+		route := modelRoute{pattern: rc.Model}
+		for _, spec := range rc.Targets {
+			target, err := parseRouteTarget(spec)
+			if err != nil {
+				return nil, fmt.Errorf("route %s: %v", rc.Model, err)
+			}
+			route.targets = append(route.targets, target)
+		}
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+// parseRouteConfigs parses the compact route syntax used by MODEL_ROUTES and
+// -routes: comma separated "pattern=target|target" rules, e.g.
+// "gpt-4o=deepseek:deepseek-chat|ollama,llama*=ollama:qwen2.5-coder,*=deepseek".
+// Malformed rules are kept with empty fields so validation reports them.
+func parseRouteConfigs(spec string) []RouteConfig {
+	var routes []RouteConfig
+	for _, rule := range strings.Split(spec, ",") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+
+		pattern, targets, _ := strings.Cut(rule, "=")
+		rc := RouteConfig{Model: strings.TrimSpace(pattern)}
+		for _, target := range strings.Split(targets, "|") {
+			if target = strings.TrimSpace(target); target != "" {
+				rc.Targets = append(rc.Targets, target)
+			}
+		}
+		routes = append(routes, rc)
+	}
+	return routes
+}
+
+// reloadConfig loads and validates the config and, only if it is valid,
+// swaps it in. In-flight requests keep the state they started with.
+func reloadConfig(flags configFlags) error {
+	cfg, err := loadConfig(flags, currentState() == nil)
+	if err != nil {
+		return err
+	}
+	st, err := cfg.validate()
+	if err != nil {
+		return fmt.Errorf("invalid config: %v", err)
+	}
+
+	if old := currentState(); old != nil && old.config.Listen != cfg.Listen {
+		log.Printf("Warning: listen address changed to %s; restart the proxy to apply it", cfg.Listen)
+	}
+
+	switch {
+	case st.clientKeys && len(st.clients) == 0:
+		log.Printf("Warning: all client keys are disabled, every request is rejected")
+	case !st.clientKeys && len(st.providerKeys) > 0:
+		log.Printf("Warning: no client keys configured, clients must use the upstream provider key")
+	}
+
+	if err := spending.load(cfg.Ledger.Path); err != nil {
+		log.Printf("Error reading usage ledger, budgets start from zero: %v", err)
+	}
+
+	responses.configure(cfg.Cache)
+
+	state.Store(st)
+	for _, route := range cfg.Routes {
+		log.Printf("Route: %s -> %s", route.Model, strings.Join(route.Targets, " -> "))
+	}
+	log.Printf("Config loaded with backends: %s (default: %s)", strings.Join(st.router.backendNames(), ", "), st.router.defaultBackend.Name())
+	return nil
+}
+
+// watchConfig reloads the config on SIGHUP and whenever the config file
+// changes on disk.
+func watchConfig(flags configFlags) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	ticker := time.NewTicker(configPollInterval)
+	defer ticker.Stop()
+
+	lastMod := configModTime(flags.path)
+	for {
+		select {
+		case <-hup:
+			log.Printf("Received SIGHUP, reloading config")
+		case <-ticker.C:
+			mod := configModTime(flags.path)
+			if mod.Equal(lastMod) {
+				continue
+			}
+			lastMod = mod
+			log.Printf("Config file %s changed, reloading", flags.path)
+		}
+
+		if err := reloadConfig(flags); err != nil {
+			log.Printf("Error reloading config, keeping the previous one: %v", err)
+		}
+	}
+}
+
+func configModTime(path string) time.Time {
+	if path == "" {
+		return time.Time{}
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReloadConfigMissingDefaultFile(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	defer state.Store(nil)
+	state.Store(nil)
+
+	flags := configFlags{path: defaultConfigPath}
+	if err := reloadConfig(flags); err != nil {
+		t.Fatalf("initial load without %s: %v", defaultConfigPath, err)
+	}
+
+	path := filepath.Join(dir, defaultConfigPath)
+	config := "clients:\n  - name: alice\n    key: sk-proxy-alice\n"
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloadConfig(flags); err != nil {
+		t.Fatal(err)
+	}
+	if !currentState().clientKeys {
+		t.Fatal("client keys not loaded")
+	}
+
+	// A file missing during a save must not reopen the proxy
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloadConfig(flags); err == nil {
+		t.Error("reload without the config file succeeded")
+	}
+	if st := currentState(); !st.clientKeys || len(st.clients) != 1 {
+		t.Errorf("the previous client keys were dropped: %+v", st.clients)
+	}
+}
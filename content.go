@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	imageFetchTimeout = 30 * time.Second
+	maxImageBytes     = 20 << 20
+)
+
+// ContentPart is one part of a multimodal message content
+type ContentPart struct {
+	Type     string    `json:"type"`
+	Text     string    `json:"text,omitempty"`
+	ImageURL *ImageURL `json:"image_url,omitempty"`
+}
+
+type ImageURL struct {
+	URL    string `json:"url"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// messageJSON has the fields of Message without its JSON methods.
+type messageJSON Message
+
+// UnmarshalJSON accepts content as a string, null or an array of parts. The
+// text of the parts is also joined into Content, so text-only code can keep
+// using it.
+func (m *Message) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		messageJSON
+		Content json.RawMessage `json:"content"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	*m = Message(raw.messageJSON)
+
+	content := bytes.TrimSpace(raw.Content)
+	switch {
+	case len(content) == 0 || string(content) == "null":
+		m.Content = ""
+	case content[0] == '[':
+		if err := json.Unmarshal(content, &m.Parts); err != nil {
+			return fmt.Errorf("invalid content parts: %v", err)
+		}
+		m.Content = partsText(m.Parts)
+	default:
+		if err := json.Unmarshal(content, &m.Content); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MarshalJSON writes the parts when the content has any, the text otherwise.
+func (m Message) MarshalJSON() ([]byte, error) {
+	if len(m.Parts) == 0 {
+		return json.Marshal(messageJSON(m))
+	}
+	return json.Marshal(struct {
+		messageJSON
+		Content []ContentPart `json:"content"`
+	}{messageJSON(m), m.Parts})
+}
+
+// images returns the image parts of the message.
+func (m *Message) images() []ImageURL {
+	var images []ImageURL
+	for _, part := range m.Parts {
+		if part.Type == "image_url" && part.ImageURL != nil {
+			images = append(images, *part.ImageURL)
+		}
+	}
+	return images
+}
+
+// partsText joins the text parts of a content.
+func partsText(parts []ContentPart) string {
+	var texts []string
+	for _, part := range parts {
+		if part.Type == "text" {
+			texts = append(texts, part.Text)
+		}
+	}
+	return strings.Join(texts, "\n")
+}
+
+// flattenContent turns multimodal messages into text for backends that do not
+// take images.
+func flattenContent(messages []Message) {
+	for i := range messages {
+		if len(messages[i].Parts) == 0 {
+			continue
+		}
+		if n := len(messages[i].images()); n > 0 {
+			log.Printf("Dropping %d image parts of message %d for a text-only backend", n, i)
+		}
+		messages[i].Parts = nil
+	}
+}
+
+// acceptsImages reports whether image parts are sent to the backend, given
+// its default.
+func (bc BackendConfig) acceptsImages(byDefault bool) bool {
+	if bc.Vision != nil {
+		return *bc.Vision
+	}
+	return byDefault
+}
+
+// ImageConfig controls downloading images that clients send as http(s) URLs
+// for backends that only take the image data.
+type ImageConfig struct {
+	// AllowedHosts are the hosts images may be downloaded from, either
+	// exactly, as "*.example.com" for subdomains or "*" for any. Empty
+	// disables downloads, so only data URLs work.
+	AllowedHosts []string `yaml:"allowed_hosts"`
+}
+
+// allows reports whether images may be downloaded from host.
+func (ic ImageConfig) allows(host string) bool {
+	host = strings.ToLower(host)
+	for _, pattern := range ic.AllowedHosts {
+		pattern = strings.ToLower(pattern)
+		switch {
+		case pattern == "*" || pattern == host:
+			return true
+		case strings.HasPrefix(pattern, "*.") && strings.HasSuffix(host, pattern[1:]):
+			return true
+		}
+	}
+	return false
+}
+
+// imageCache holds the images of one request that were downloaded, or
+// refused, so each image URL is fetched at most once.
+type imageCache struct {
+	config  ImageConfig
+	results map[string]imageResult
+}
+
+type imageResult struct {
+	dataURL string
+	err     error
+}
+
+func newImageCache(ic ImageConfig) *imageCache {
+	return &imageCache{config: ic, results: map[string]imageResult{}}
+}
+
+// fetch returns the image as a data URL. A nil cache allows no downloads.
+func (c *imageCache) fetch(ctx context.Context, imageURL string) (string, error) {
+	if c == nil {
+		return fetchImage(ctx, ImageConfig{}, imageURL)
+	}
+	result, ok := c.results[imageURL]
+	if !ok {
+		result.dataURL, result.err = fetchImage(ctx, c.config, imageURL)
+		c.results[imageURL] = result
+	}
+	return result.dataURL, result.err
+}
+
+// errImageDownload is returned for requests whose images could not be
+// downloaded for a backend that needs the image data.
+type errImageDownload struct {
+	err error
+}
+
+func (e *errImageDownload) Error() string {
+	return e.err.Error()
+}
+
+// inlineImages returns chatReq with the images given as http(s) URLs
+// replaced by data URLs, for backends that need the image data. The
+// downloads are cached on the request, so fallback targets and retries reuse
+// them.
+func inlineImages(ctx context.Context, chatReq *ChatRequest) (*ChatRequest, error) {
+	var inlined *ChatRequest
+	for i, msg := range chatReq.Messages {
+		var parts []ContentPart
+		for j, part := range msg.Parts {
+			if part.Type != "image_url" || part.ImageURL == nil || strings.HasPrefix(part.ImageURL.URL, "data:") {
+				continue
+			}
+			dataURL, err := chatReq.images.fetch(ctx, part.ImageURL.URL)
+			if err != nil {
+				return nil, &errImageDownload{fmt.Errorf("message %d: %v", i, err)}
+			}
+			if parts == nil {
+				parts = append([]ContentPart(nil), msg.Parts...)
+			}
+			parts[j].ImageURL = &ImageURL{URL: dataURL, Detail: part.ImageURL.Detail}
+		}
+		if parts == nil {
+			continue
+		}
+		if inlined == nil {
+			copied := *chatReq
+			copied.Messages = append([]Message(nil), chatReq.Messages...)
+			inlined = &copied
+		}
+		inlined.Messages[i].Parts = parts
+	}
+	if inlined == nil {
+		return chatReq, nil
+	}
+	return inlined, nil
+}
+
+// fetchImage downloads an image from an allowed host and returns it as a
+// data URL. Redirects must stay on allowed hosts too.
+func fetchImage(ctx context.Context, ic ImageConfig, imageURL string) (string, error) {
+	u, err := url.Parse(imageURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return "", fmt.Errorf("unsupported image URL %q", truncateString(imageURL, 50))
+	}
+	if !ic.allows(u.Hostname()) {
+		return "", fmt.Errorf("downloading images from %s is not allowed, send the image as a data URL", u.Hostname())
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, imageFetchTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, imageURL, nil)
+	if err != nil {
+		return "", fmt.Errorf("error fetching image: %v", err)
+	}
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if !ic.allows(req.URL.Hostname()) {
+				return fmt.Errorf("redirect to %s is not allowed", req.URL.Hostname())
+			}
+			if len(via) >= 10 {
+				return fmt.Errorf("stopped after 10 redirects")
+			}
+			return nil
+		},
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("error fetching image: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("error fetching image: status %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxImageBytes+1))
+	if err != nil {
+		return "", fmt.Errorf("error fetching image: %v", err)
+	}
+	if len(data) > maxImageBytes {
+		return "", fmt.Errorf("image is larger than %d bytes", maxImageBytes)
+	}
+
+	mediaType := resp.Header.Get("Content-Type")
+	if !strings.HasPrefix(mediaType, "image/") {
+		mediaType = http.DetectContentType(data)
+	}
+	return "data:" + mediaType + ";base64," + base64.StdEncoding.EncodeToString(data), nil
+}
+
+// imageBase64 returns the base64 data of an image given as a data URL.
+// Images given as http(s) URLs are downloaded by inlineImages beforehand.
+func imageBase64(imageURL string) (string, error) {
+	if !strings.HasPrefix(imageURL, "data:") {
+		return "", fmt.Errorf("unsupported image URL %q", truncateString(imageURL, 50))
+	}
+	meta, data, ok := strings.Cut(imageURL[len("data:"):], ",")
+	if !ok {
+		return "", fmt.Errorf("invalid data URL")
+	}
+	if strings.HasSuffix(meta, ";base64") {
+		return data, nil
+	}
+	decoded, err := url.PathUnescape(data)
+	if err != nil {
+		return "", fmt.Errorf("invalid data URL: %v", err)
+	}
+	return base64.StdEncoding.EncodeToString([]byte(decoded)), nil
+}
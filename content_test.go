@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestImageConfigAllows(t *testing.T) {
+	ic := ImageConfig{AllowedHosts: []string{"images.example.com", "*.cdn.example.org"}}
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{"images.example.com", true},
+		{"IMAGES.example.com", true},
+		{"example.com", false},
+		{"a.cdn.example.org", true},
+		{"cdn.example.org", false},
+		{"evilcdn.example.org", false},
+		{"169.254.169.254", false},
+	}
+	for _, tt := range tests {
+		if got := ic.allows(tt.host); got != tt.want {
+			t.Errorf("allows(%q) = %v, want %v", tt.host, got, tt.want)
+		}
+	}
+	if (ImageConfig{}).allows("images.example.com") {
+		t.Error("downloads allowed without allowed_hosts")
+	}
+	if !(ImageConfig{AllowedHosts: []string{"*"}}).allows("anything.test") {
+		t.Error(`"*" does not allow every host`)
+	}
+}
+
+func TestInlineImages(t *testing.T) {
+	png := "\x89PNG\r\n\x1a\n"
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, "http://localhost"+strings.TrimPrefix(r.Host, "127.0.0.1")+"/image.png", http.StatusFound)
+			return
+		}
+		w.Write([]byte(png))
+	}))
+	defer server.Close()
+	host := strings.Split(strings.TrimPrefix(server.URL, "http://"), ":")[0]
+
+	allowed := ImageConfig{AllowedHosts: []string{host}}
+	newRequest := func(ic ImageConfig, imageURL string) *ChatRequest {
+		return &ChatRequest{
+			Messages: []Message{{
+				Role: "user",
+				Parts: []ContentPart{
+					{Type: "text", Text: "What is this?"},
+					{Type: "image_url", ImageURL: &ImageURL{URL: imageURL}},
+				},
+			}},
+			images: newImageCache(ic),
+		}
+	}
+
+	t.Run("disabled by default", func(t *testing.T) {
+		_, err := inlineImages(context.Background(), newRequest(ImageConfig{}, server.URL+"/image.png"))
+		var imageErr *errImageDownload
+		if !errors.As(err, &imageErr) || requests != 0 {
+			t.Fatalf("err = %v after %d requests, want an error before any request", err, requests)
+		}
+	})
+
+	t.Run("allowed host", func(t *testing.T) {
+		chatReq := newRequest(allowed, server.URL+"/image.png")
+		inlined, err := inlineImages(context.Background(), chatReq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := inlined.Messages[0].Parts[1].ImageURL.URL
+		if !strings.HasPrefix(got, "data:image/png;base64,") {
+			t.Errorf("image URL = %q, want a PNG data URL", truncateString(got, 40))
+		}
+		if chatReq.Messages[0].Parts[1].ImageURL.URL != server.URL+"/image.png" {
+			t.Error("the original request was modified")
+		}
+		data, err := imageBase64(got)
+		if err != nil || data == "" {
+			t.Errorf("imageBase64 of the inlined URL: %q, %v", data, err)
+		}
+
+		// Copies of the request for fallbacks and retries reuse the download
+		before := requests
+		retry := *chatReq
+		if _, err := inlineImages(context.Background(), &retry); err != nil || requests != before {
+			t.Errorf("inlining again: %v after %d more requests, want the cached image", err, requests-before)
+		}
+	})
+
+	t.Run("redirect to another host", func(t *testing.T) {
+		_, err := inlineImages(context.Background(), newRequest(allowed, server.URL+"/redirect"))
+		if err == nil || !strings.Contains(err.Error(), "redirect") {
+			t.Errorf("err = %v, want the redirect to be refused", err)
+		}
+	})
+
+	t.Run("data URLs are kept", func(t *testing.T) {
+		chatReq := newRequest(ImageConfig{}, "data:image/png;base64,AAAA")
+		inlined, err := inlineImages(context.Background(), chatReq)
+		if err != nil || inlined != chatReq {
+			t.Errorf("got %p, %v, want the request unchanged", inlined, err)
+		}
+	})
+}
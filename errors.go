@@ -0,0 +1,35 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// OpenAIError is the body of an OpenAI-style error response
+type OpenAIError struct {
+	Error OpenAIErrorDetail `json:"error"`
+}
+
+type OpenAIErrorDetail struct {
+	Message string  `json:"message"`
+	Type    string  `json:"type"`
+	Param   *string `json:"param"`
+	Code    string  `json:"code,omitempty"`
+}
+
+// writeOpenAIError writes an error in the format OpenAI clients expect, so
+// they can show the message and react to the type and code.
+func writeOpenAIError(w http.ResponseWriter, status int, errType, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(OpenAIError{
+		Error: OpenAIErrorDetail{
+			Message: message,
+			Type:    errType,
+			Code:    code,
+		},
+	}); err != nil {
+		log.Printf("Error writing error response: %v", err)
+	}
+}
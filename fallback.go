@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// isRetryableStatus reports whether an upstream status should make the proxy
+// try the next target in the fallback chain.
+func isRetryableStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status >= 500
+}
+
+// sendWithFallback tries each target in order until one answers with a
+// non-retryable status. It runs before anything is written to the client, so
+// a failed attempt is invisible to it. The last target's response is returned
+// whatever its status so an upstream error can still be forwarded; an error is
+// returned only when no target produced a response. The caller owns resp.Body.
+func sendWithFallback(ctx context.Context, r *http.Request, chatReq *ChatRequest, targets []upstreamTarget) (upstreamTarget, *http.Response, error) {
+	var lastErr error
+	for i, target := range targets {
+		if i > 0 {
+			log.Printf("Falling back to %s:%s", target.backend.Name(), target.model)
+		}
+
+		req := chatReq
+		if target.forced != nil {
+			req = target.forced.apply(req)
+		}
+		if target.backend.NeedsImageData() {
+			inlined, err := inlineImages(ctx, req)
+			if err != nil {
+				lastErr = err
+				log.Printf("Skipping %s, it needs the image data: %v", target.backend.Name(), err)
+				continue
+			}
+			req = inlined
+		}
+
+		// The upstream may stream when the client does not or vice versa
+		if target.stream != req.Stream {
+			bridged := *req
+			bridged.Stream = target.stream
+			req = &bridged
+		}
+
+		// Convert to the backend's request format
+		modifiedBody, tr, err := target.backend.TranslateRequest(req, target.model)
+		if err != nil {
+			lastErr = fmt.Errorf("error creating %s request: %v", target.backend.Name(), err)
+			log.Printf("%v", lastErr)
+			continue
+		}
+
+		log.Printf("Modified request body: %s", string(modifiedBody))
+
+		// Send the request. Each attempt has its own timeout, so a target
+		// that hangs is given up while the next one can still answer.
+		attemptCtx, cancelAttempt := context.WithCancel(ctx)
+		stopTimer := func() bool { return true }
+		if target.timeout > 0 {
+			stopTimer = time.AfterFunc(target.timeout, cancelAttempt).Stop
+		}
+		resp, err := target.backend.Send(attemptCtx, r, modifiedBody, target.stream)
+		if err != nil {
+			timedOut := !stopTimer() && ctx.Err() == nil
+			cancelAttempt()
+			if timedOut {
+				err = fmt.Errorf("no response within %s", target.timeout)
+			}
+			lastErr = fmt.Errorf("error forwarding request to %s: %v", target.backend.Name(), err)
+			log.Printf("%v", lastErr)
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+		if target.stream {
+			// Streams are watched for silence from here on
+			stopTimer()
+		}
+		resp.Body = &attemptBody{ReadCloser: resp.Body, stopTimer: stopTimer, cancel: cancelAttempt}
+
+		log.Printf("%s response status: %d", target.backend.Name(), resp.StatusCode)
+		log.Printf("%s response headers: %v", target.backend.Name(), resp.Header)
+
+		if isRetryableStatus(resp.StatusCode) && i < len(targets)-1 {
+			body, _ := readResponse(resp)
+			resp.Body.Close()
+			lastErr = fmt.Errorf("%s returned status %d", target.backend.Name(), resp.StatusCode)
+			log.Printf("%v: %s", lastErr, string(body))
+			continue
+		}
+
+		target.translation = tr
+		return target, resp, nil
+	}
+
+	if lastErr == nil {
+		lastErr = errors.New("no upstream targets configured")
+	}
+	return upstreamTarget{}, nil, lastErr
+}
+
+// attemptBody ends the attempt the response belongs to once it is closed.
+type attemptBody struct {
+	io.ReadCloser
+	stopTimer func() bool
+	cancel    context.CancelFunc
+}
+
+func (b *attemptBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.stopTimer()
+	b.cancel()
+	return err
+}
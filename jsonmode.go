@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// jsonMode reports whether the format asks for JSON output.
+func (rf *ResponseFormat) jsonMode() bool {
+	return rf != nil && (rf.Type == "json_object" || rf.Type == "json_schema")
+}
+
+// schema returns the JSON schema of a json_schema format, or nil.
+func (rf *ResponseFormat) schema() json.RawMessage {
+	if rf == nil || rf.Type != "json_schema" || rf.JSONSchema == nil {
+		return nil
+	}
+	return rf.JSONSchema.Schema
+}
+
+// instruction asks for JSON output in the prompt, for backends whose JSON
+// mode cannot take a schema or needs the prompt to mention JSON.
+func (rf *ResponseFormat) instruction() string {
+	if schema := rf.schema(); len(schema) > 0 {
+		return fmt.Sprintf("Respond only with JSON that matches this JSON schema, without any other text or code fences:\n%s", schema)
+	}
+	return "Respond only with a valid JSON object, without any other text or code fences."
+}
+
+// jsonFormatCheck makes sure that an answer in JSON mode is valid JSON and
+// matches the requested schema. Backends constrain their output to JSON at
+// best, so the proxy validates it and asks once more with the error.
+type jsonFormatCheck struct {
+	format *ResponseFormat
+	schema *jsonSchema // nil for json_object
+}
+
+// parseJSONFormatCheck returns the check for the response_format of a
+// request, or nil when it does not ask for JSON.
+func parseJSONFormatCheck(chatReq *ChatRequest) (*jsonFormatCheck, error) {
+	rf := chatReq.ResponseFormat
+	if rf == nil {
+		return nil, nil
+	}
+	switch rf.Type {
+	case "", "text":
+		return nil, nil
+	case "json_object":
+		return &jsonFormatCheck{format: rf}, nil
+	case "json_schema":
+		if len(rf.schema()) == 0 {
+			return nil, fmt.Errorf("response_format json_schema requires json_schema.schema")
+		}
+		schema, err := compileSchema(rf.schema())
+		if err != nil {
+			return nil, err
+		}
+		return &jsonFormatCheck{format: rf, schema: schema}, nil
+	}
+	return nil, fmt.Errorf("unsupported response_format type %q", rf.Type)
+}
+
+// check fails answers that are not JSON or do not match the schema. JSON
+// that is wrapped in a code fence or surrounded by text is repaired.
+func (c *jsonFormatCheck) check(completion *chatCompletion) error {
+	if len(completion.Choices) == 0 {
+		return fmt.Errorf("the answer has no choices")
+	}
+	for i := range completion.Choices {
+		msg := &completion.Choices[i].Message
+		if len(msg.ToolCalls) > 0 && strings.TrimSpace(msg.Content) == "" {
+			// Tool calls are not held to the response format
+			continue
+		}
+
+		text, v, err := extractJSON(msg.Content)
+		if err != nil {
+			if completion.Choices[i].FinishReason == "length" {
+				return fmt.Errorf("the answer was cut off at the token limit and is not valid JSON")
+			}
+			return fmt.Errorf("the answer is not valid JSON: %v", err)
+		}
+		if c.schema == nil {
+			if _, ok := v.(map[string]interface{}); !ok {
+				return fmt.Errorf("the answer is a JSON %s, not an object", jsonType(v))
+			}
+		} else if err := c.schema.validate(v); err != nil {
+			return fmt.Errorf("the answer does not match the JSON schema: %v", err)
+		}
+		msg.Content = text
+	}
+	return nil
+}
+
+// retry shows the model its answer and what is wrong with it.
+func (c *jsonFormatCheck) retry(chatReq *ChatRequest, answer *chatCompletion, err error) *ChatRequest {
+	req := *chatReq
+	req.Messages = append([]Message(nil), chatReq.Messages...)
+	if len(answer.Choices) > 0 {
+		req.Messages = append(req.Messages, Message{
+			Role:    "assistant",
+			Content: answer.Choices[0].Message.Content,
+		})
+	}
+	req.Messages = append(req.Messages, Message{
+		Role:    "user",
+		Content: fmt.Sprintf("Your previous answer was rejected: %v. Reply again with only the corrected JSON.", err),
+	})
+	return &req
+}
+
+// strict is true: the client gets valid JSON or an error.
+func (c *jsonFormatCheck) strict() bool {
+	return true
+}
+
+// extractJSON returns the JSON value in an answer, which may be wrapped in a
+// code fence or surrounded by text.
+func extractJSON(text string) (string, interface{}, error) {
+	text = strings.TrimSpace(text)
+	if strings.HasPrefix(text, "```") {
+		if _, body, ok := strings.Cut(text, "\n"); ok {
+			text = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(body), "```"))
+		}
+	}
+
+	var v interface{}
+	err := json.Unmarshal([]byte(text), &v)
+	if err == nil {
+		return text, v, nil
+	}
+
+	// Take the outermost object or array
+	start := strings.IndexAny(text, "{[")
+	if start < 0 {
+		return "", nil, err
+	}
+	closer := "}"
+	if text[start] == '[' {
+		closer = "]"
+	}
+	end := strings.LastIndex(text, closer)
+	if end <= start {
+		return "", nil, err
+	}
+	inner := text[start : end+1]
+	if json.Unmarshal([]byte(inner), &v) != nil {
+		return "", nil, err
+	}
+	return inner, v, nil
+}
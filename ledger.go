@@ -0,0 +1,477 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+const defaultLedgerPath = "usage.jsonl"
+
+// LedgerConfig configures the usage ledger. An empty path disables it.
+type LedgerConfig struct {
+	Path string `yaml:"path"`
+
+	// Transcripts, when set, is a JSON Lines file that receives every
+	// answer as one chat.completion, streamed ones reassembled
+	Transcripts string `yaml:"transcripts"`
+}
+
+// UsageRecord is one completed request in the usage ledger
+type UsageRecord struct {
+	Time             time.Time `json:"time"`
+	Client           string    `json:"client"`
+	RequestedModel   string    `json:"requested_model"`
+	UpstreamModel    string    `json:"upstream_model"`
+	Backend          string    `json:"backend"`
+	Stream           bool      `json:"stream"`
+	Status           int       `json:"status"`
+	PromptTokens     int       `json:"prompt_tokens"`
+	CompletionTokens int       `json:"completion_tokens"`
+	TotalTokens      int       `json:"total_tokens"`
+	CachedTokens     int       `json:"cached_tokens,omitempty"`
+	Cost             *float64  `json:"cost,omitempty"`      // unset when the model has no price
+	Estimated        bool      `json:"estimated,omitempty"` // token counts are local estimates
+	CacheHit         bool      `json:"cache_hit,omitempty"` // served from the response cache
+	LatencyMs        int64     `json:"latency_ms"`
+	FinishReason     string    `json:"finish_reason,omitempty"`
+}
+
+// completionResult is what the proxy learned from an upstream answer.
+type completionResult struct {
+	usage        *Usage
+	finishReason string
+	content      string // answer text, for estimating missing usage
+
+	// Usage of earlier answers that were retried; the upstream billed them
+	// all the same
+	discarded          *Usage
+	discardedEstimated bool
+}
+
+// result returns what the proxy needs to know about a completion.
+func (c *chatCompletion) result() completionResult {
+	result := completionResult{usage: c.Usage}
+	if len(c.Choices) > 0 {
+		result.finishReason = c.Choices[0].FinishReason
+		result.content = c.Choices[0].Message.Content
+	}
+	return result
+}
+
+// parseCompletionResult reads usage, content and finish reason from an
+// OpenAI-format chat.completion body.
+func parseCompletionResult(body []byte) completionResult {
+	var completion chatCompletion
+	if err := json.Unmarshal(body, &completion); err != nil {
+		return completionResult{}
+	}
+	return completion.result()
+}
+
+// streamTap passes a stream through to the client while joining the
+// chat.completion.chunk events into the completion the client received.
+type streamTap struct {
+	http.ResponseWriter
+	partial    []byte
+	aggregator completionAggregator
+
+	// record keeps the data of every chunk for the response cache
+	record bool
+	chunks [][]byte
+}
+
+func newStreamTap(w http.ResponseWriter) *streamTap {
+	return &streamTap{ResponseWriter: w}
+}
+
+func (t *streamTap) Write(p []byte) (int, error) {
+	t.partial = append(t.partial, p...)
+	for {
+		i := bytes.IndexByte(t.partial, '\n')
+		if i < 0 {
+			break
+		}
+		t.observe(t.partial[:i])
+		t.partial = t.partial[i+1:]
+	}
+	return t.ResponseWriter.Write(p)
+}
+
+func (t *streamTap) Flush() {
+	if f, ok := t.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (t *streamTap) observe(line []byte) {
+	line = bytes.TrimSpace(line)
+	if !bytes.HasPrefix(line, []byte("data:")) {
+		return
+	}
+	data := bytes.TrimSpace(line[len("data:"):])
+	if len(data) == 0 || string(data) == "[DONE]" {
+		return
+	}
+
+	if !json.Valid(data) {
+		return
+	}
+	if t.record {
+		t.chunks = append(t.chunks, append([]byte(nil), data...))
+	}
+	t.aggregator.add(data)
+}
+
+// transcript returns the streamed answer as one chat.completion.
+func (t *streamTap) transcript() *chatCompletion {
+	return t.aggregator.completion()
+}
+
+// TranscriptRecord is one answer in the transcript file
+type TranscriptRecord struct {
+	Time          time.Time       `json:"time"`
+	Client        string          `json:"client"`
+	Backend       string          `json:"backend"`
+	UpstreamModel string          `json:"upstream_model"`
+	Stream        bool            `json:"stream"`
+	Completion    *chatCompletion `json:"completion"`
+}
+
+// saveTranscript appends the answer to a request to the transcript file.
+func (st *proxyState) saveTranscript(rec UsageRecord, completion *chatCompletion) {
+	err := ledger.append(st.config.Ledger.Transcripts, TranscriptRecord{
+		Time:          rec.Time,
+		Client:        rec.Client,
+		Backend:       rec.Backend,
+		UpstreamModel: rec.UpstreamModel,
+		Stream:        rec.Stream,
+		Completion:    completion,
+	})
+	if err != nil {
+		log.Printf("Error writing transcript: %v", err)
+	}
+}
+
+// usageLedger appends records to a JSON Lines file.
+type usageLedger struct {
+	mu sync.Mutex
+}
+
+var ledger = &usageLedger{}
+
+func (l *usageLedger) append(path string, rec interface{}) error {
+	if path == "" {
+		return nil
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(line, '\n'))
+	return err
+}
+
+// recordUsage completes rec with the upstream result and appends it to the
+// ledger. Streams without reported usage get local estimates.
+func recordUsage(st *proxyState, rec UsageRecord, chatReq *ChatRequest, result completionResult, start time.Time) UsageRecord {
+	usage := result.usage
+	if usage == nil && rec.Status < 400 {
+		prompt := estimatePromptTokens(chatReq)
+		completion := estimateTokens(result.content)
+		usage = &Usage{
+			PromptTokens:     prompt,
+			CompletionTokens: completion,
+			TotalTokens:      prompt + completion,
+		}
+		rec.Estimated = true
+	}
+	if result.discarded != nil {
+		usage = usage.plus(result.discarded)
+		rec.Estimated = rec.Estimated || result.discardedEstimated
+	}
+	if usage != nil {
+		rec.PromptTokens = usage.PromptTokens
+		rec.CompletionTokens = usage.CompletionTokens
+		rec.TotalTokens = usage.TotalTokens
+		rec.CachedTokens = usage.cachedTokens()
+		if price, ok := st.priceFor(rec.Backend, rec.UpstreamModel); ok {
+			cost := price.cost(usage)
+			rec.Cost = &cost
+		}
+	}
+	rec.FinishReason = result.finishReason
+	rec.LatencyMs = time.Since(start).Milliseconds()
+
+	if err := ledger.append(st.config.Ledger.Path, rec); err != nil {
+		log.Printf("Error writing usage ledger: %v", err)
+	}
+	spending.add(rec)
+	st.checkBudgetCaps(rec)
+	return rec
+}
+
+// usage returns the token counts of the record, or nil when there are none.
+func (rec UsageRecord) usage() *Usage {
+	if rec.TotalTokens == 0 && rec.PromptTokens == 0 {
+		return nil
+	}
+	return &Usage{
+		PromptTokens:     rec.PromptTokens,
+		CompletionTokens: rec.CompletionTokens,
+		TotalTokens:      rec.TotalTokens,
+	}
+}
+
+// usageQuery selects and groups ledger records.
+type usageQuery struct {
+	groupBy []string // any of day, client, model, upstream_model, backend
+	since   time.Time
+	until   time.Time
+	client  string
+	model   string
+}
+
+// UsageTotals is one group of the usage report
+type UsageTotals struct {
+	Day              string  `json:"day,omitempty"`
+	Client           string  `json:"client,omitempty"`
+	Model            string  `json:"model,omitempty"`
+	UpstreamModel    string  `json:"upstream_model,omitempty"`
+	Backend          string  `json:"backend,omitempty"`
+	Requests         int     `json:"requests"`
+	PromptTokens     int     `json:"prompt_tokens"`
+	CompletionTokens int     `json:"completion_tokens"`
+	TotalTokens      int     `json:"total_tokens"`
+	CachedTokens     int     `json:"cached_tokens"`
+	Cost             float64 `json:"cost"`
+}
+
+var usageGroupFields = map[string]bool{
+	"day":            true,
+	"client":         true,
+	"model":          true,
+	"upstream_model": true,
+	"backend":        true,
+}
+
+// parseUsageQuery builds a query from the group_by, since, until, client and
+// model parameters. Dates are YYYY-MM-DD in UTC; until is inclusive.
+func parseUsageQuery(get func(string) string) (usageQuery, error) {
+	q := usageQuery{
+		client: get("client"),
+		model:  get("model"),
+	}
+
+	groupBy := get("group_by")
+	if groupBy == "" {
+		groupBy = "day,client,model"
+	}
+	for _, field := range strings.Split(groupBy, ",") {
+		field = strings.TrimSpace(field)
+		if !usageGroupFields[field] {
+			return q, fmt.Errorf("invalid group_by field %q", field)
+		}
+		q.groupBy = append(q.groupBy, field)
+	}
+
+	for name, dst := range map[string]*time.Time{"since": &q.since, "until": &q.until} {
+		if v := get(name); v != "" {
+			t, err := time.Parse("2006-01-02", v)
+			if err != nil {
+				return q, fmt.Errorf("invalid %s date %q, expected YYYY-MM-DD", name, v)
+			}
+			*dst = t
+		}
+	}
+	if !q.until.IsZero() {
+		q.until = q.until.AddDate(0, 0, 1)
+	}
+
+	return q, nil
+}
+
+func (q usageQuery) matches(rec UsageRecord) bool {
+	if !q.since.IsZero() && rec.Time.Before(q.since) {
+		return false
+	}
+	if !q.until.IsZero() && !rec.Time.Before(q.until) {
+		return false
+	}
+	if q.client != "" && rec.Client != q.client {
+		return false
+	}
+	if q.model != "" && rec.RequestedModel != q.model {
+		return false
+	}
+	return true
+}
+
+func (q usageQuery) groupKey(rec UsageRecord) UsageTotals {
+	var key UsageTotals
+	for _, field := range q.groupBy {
+		switch field {
+		case "day":
+			key.Day = rec.Time.UTC().Format("2006-01-02")
+		case "client":
+			key.Client = rec.Client
+		case "model":
+			key.Model = rec.RequestedModel
+		case "upstream_model":
+			key.UpstreamModel = rec.UpstreamModel
+		case "backend":
+			key.Backend = rec.Backend
+		}
+	}
+	return key
+}
+
+// queryUsage aggregates the ledger at path.
+func queryUsage(path string, q usageQuery) ([]UsageTotals, error) {
+	totals := map[UsageTotals]*UsageTotals{}
+	err := readLedger(path, func(rec UsageRecord) {
+		if !q.matches(rec) {
+			return
+		}
+		key := q.groupKey(rec)
+		t, ok := totals[key]
+		if !ok {
+			t = &UsageTotals{}
+			*t = key
+			totals[key] = t
+		}
+		t.Requests++
+		t.PromptTokens += rec.PromptTokens
+		t.CompletionTokens += rec.CompletionTokens
+		t.TotalTokens += rec.TotalTokens
+		t.CachedTokens += rec.CachedTokens
+		if rec.Cost != nil {
+			t.Cost += *rec.Cost
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]UsageTotals, 0, len(totals))
+	for _, t := range totals {
+		result = append(result, *t)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		a, b := result[i], result[j]
+		for _, pair := range [][2]string{{a.Day, b.Day}, {a.Client, b.Client}, {a.Model, b.Model}, {a.UpstreamModel, b.UpstreamModel}, {a.Backend, b.Backend}} {
+			if pair[0] != pair[1] {
+				return pair[0] < pair[1]
+			}
+		}
+		return false
+	})
+	return result, nil
+}
+
+// readLedger calls fn for every record in the ledger. A missing ledger is
+// empty.
+func readLedger(path string, fn func(UsageRecord)) error {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var rec UsageRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			log.Printf("Skipping malformed ledger line: %v", err)
+			continue
+		}
+		fn(rec)
+	}
+	return scanner.Err()
+}
+
+// handleUsageRequest serves GET /v1/usage. Admin clients can query every
+// client; everyone else only sees their own usage.
+func handleUsageRequest(w http.ResponseWriter, r *http.Request, st *proxyState, client *clientIdentity) {
+	q, err := parseUsageQuery(r.URL.Query().Get)
+	if err != nil {
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "", err.Error())
+		return
+	}
+	if !client.admin {
+		q.client = client.name
+	}
+
+	totals, err := queryUsage(st.config.Ledger.Path, q)
+	if err != nil {
+		log.Printf("Error reading usage ledger: %v", err)
+		writeOpenAIError(w, http.StatusInternalServerError, "server_error", "", "Error reading usage ledger")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Object string        `json:"object"`
+		Data   []UsageTotals `json:"data"`
+	}{
+		Object: "list",
+		Data:   totals,
+	})
+}
+
+// printUsageReport writes the usage report as a table, for the -usage CLI.
+func printUsageReport(out io.Writer, path string, q usageQuery) error {
+	totals, err := queryUsage(path, q)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	header := append([]string{}, q.groupBy...)
+	header = append(header, "requests", "prompt_tokens", "completion_tokens", "total_tokens", "cost")
+	fmt.Fprintln(tw, strings.ToUpper(strings.Join(header, "\t")))
+	for _, t := range totals {
+		var cols []string
+		for _, field := range q.groupBy {
+			switch field {
+			case "day":
+				cols = append(cols, t.Day)
+			case "client":
+				cols = append(cols, t.Client)
+			case "model":
+				cols = append(cols, t.Model)
+			case "upstream_model":
+				cols = append(cols, t.UpstreamModel)
+			case "backend":
+				cols = append(cols, t.Backend)
+			}
+		}
+		cols = append(cols, fmt.Sprint(t.Requests), fmt.Sprint(t.PromptTokens), fmt.Sprint(t.CompletionTokens), fmt.Sprint(t.TotalTokens), formatCost(t.Cost))
+		fmt.Fprintln(tw, strings.Join(cols, "\t"))
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// costHeader reports the estimated spend of a request. For streams it is sent
+// as a trailer because the cost is only known at the end.
+const costHeader = "X-Request-Cost"
+
+// ModelPrice is the price per million tokens of one upstream model, in
+// whatever currency the table is kept in.
+type ModelPrice struct {
+	Input       float64 `yaml:"input"`        // prompt tokens, or cache misses when caching is reported
+	CachedInput float64 `yaml:"cached_input"` // prompt tokens served from the provider's cache
+	Output      float64 `yaml:"output"`
+}
+
+func (p ModelPrice) validate() error {
+	if p.Input < 0 || p.CachedInput < 0 || p.Output < 0 {
+		return fmt.Errorf("prices must not be negative")
+	}
+	return nil
+}
+
+// priceFor looks up the price of model on backend. Entries keyed
+// "backend:model" take precedence over plain model names.
+func (st *proxyState) priceFor(backend, model string) (ModelPrice, bool) {
+	if p, ok := st.config.Pricing[backend+":"+model]; ok {
+		return p, true
+	}
+	p, ok := st.config.Pricing[model]
+	return p, ok
+}
+
+// cost computes the spend for usage. Cache hits are charged at the cached
+// input price when the upstream reports them.
+func (p ModelPrice) cost(usage *Usage) float64 {
+	if usage == nil {
+		return 0
+	}
+
+	hit := usage.cachedTokens()
+	miss := usage.PromptTokens - hit
+	if usage.PromptCacheMissTokens > 0 {
+		miss = usage.PromptCacheMissTokens
+	}
+
+	return (float64(miss)*p.Input + float64(hit)*p.CachedInput + float64(usage.CompletionTokens)*p.Output) / 1e6
+}
+
+func formatCost(cost float64) string {
+	return strconv.FormatFloat(cost, 'f', 8, 64)
+}
+
+// declareCostTrailer announces the cost trailer of a streaming response. It
+// must be called before the headers are written.
+func declareCostTrailer(w http.ResponseWriter) {
+	w.Header().Add("Trailer", costHeader)
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	deepseekEndpoint      = "https://api.deepseek.com"
+	deepseekBetaEndpoint  = "https://api.deepseek.com/beta"
+	deepseekChatModel     = "deepseek-chat"
+	deepseekCoderModel    = "deepseek-coder"
+	deepseekReasonerModel = "deepseek-reasoner"
+	gpt4oModel            = "gpt-4o"
+)
+
+// DeepSeek request structure
+type DeepSeekRequest struct {
+	Model       string      `json:"model"`
+	Messages    []Message   `json:"messages"`
+	Stream      bool        `json:"stream"`
+	Temperature *float64    `json:"temperature,omitempty"`
+	MaxTokens   int         `json:"max_tokens,omitempty"`
+	Tools       []Tool      `json:"tools,omitempty"`
+	ToolChoice  interface{} `json:"tool_choice,omitempty"`
+
+	StreamOptions  *StreamOptions  `json:"stream_options,omitempty"`
+	ResponseFormat *ResponseFormat `json:"response_format,omitempty"`
+}
+
+type deepseekBackend struct {
+	config   BackendConfig
+	endpoint string
+	model    string
+	client   *http.Client
+}
+
+// newDeepSeekBackend configures the DeepSeek backend. The model may also be
+// given as the short names "chat", "coder" or "reasoner".
+func newDeepSeekBackend(cfg BackendConfig) (Backend, error) {
+	if cfg.APIKey == "" {
+		return nil, errors.New("api_key is required")
+	}
+
+	b := &deepseekBackend{
+		config: cfg,
+		client: newHTTP2Client(),
+	}
+
+	// Configure the active endpoint and model based on the model name
+	switch cfg.Model {
+	case "coder", deepseekCoderModel:
+		b.endpoint = deepseekBetaEndpoint
+		b.model = deepseekCoderModel
+	case "chat", "":
+		b.endpoint = deepseekEndpoint
+		b.model = deepseekChatModel
+	case "reasoner":
+		b.endpoint = deepseekEndpoint
+		b.model = deepseekReasonerModel
+	default:
+		b.endpoint = deepseekEndpoint
+		b.model = cfg.Model
+	}
+
+	if cfg.Endpoint != "" {
+		b.endpoint = cfg.Endpoint
+	}
+
+	return b, nil
+}
+
+func (b *deepseekBackend) Name() string { return "deepseek" }
+
+func (b *deepseekBackend) DefaultModel() string { return b.model }
+
+func (b *deepseekBackend) NeedsImageData() bool { return false }
+
+func (b *deepseekBackend) NativeToolChoice() bool { return false }
+
+func (b *deepseekBackend) Models() []Model {
+	models := []Model{
+		{
+			ID:      b.model,
+			Object:  "model",
+			Created: time.Now().Unix(),
+			OwnedBy: "deepseek",
+		},
+	}
+	if b.model != deepseekReasonerModel && b.endpoint != deepseekBetaEndpoint {
+		models = append(models, Model{
+			ID:      deepseekReasonerModel,
+			Object:  "model",
+			Created: time.Now().Unix(),
+			OwnedBy: "deepseek",
+		})
+	}
+	return models
+}
+
+func (b *deepseekBackend) TranslateRequest(chatReq *ChatRequest, model string) ([]byte, translation, error) {
+	// Convert to DeepSeek request format
+	deepseekReq := DeepSeekRequest{
+		Model:    model,
+		Messages: convertMessages(chatReq.Messages),
+		Stream:   chatReq.Stream,
+	}
+	if chatReq.Stream {
+		// Usage is always requested so streams can be accounted; the proxy
+		// passes it on only when the client asked for it
+		deepseekReq.StreamOptions = &StreamOptions{IncludeUsage: true}
+	}
+
+	// deepseek-chat only reads text
+	if !b.config.acceptsImages(false) {
+		flattenContent(deepseekReq.Messages)
+	}
+
+	// DeepSeek's JSON mode knows no schemas and needs the prompt to ask for
+	// JSON, so the schema is given there
+	if chatReq.ResponseFormat.jsonMode() {
+		deepseekReq.ResponseFormat = &ResponseFormat{Type: "json_object"}
+		deepseekReq.Messages = append(deepseekReq.Messages, Message{
+			Role:    "system",
+			Content: chatReq.ResponseFormat.instruction(),
+		})
+	}
+
+	// Copy optional parameters if present
+	b.config.applyDefaults(&deepseekReq.Temperature, &deepseekReq.MaxTokens, chatReq)
+
+	// Handle tools/functions
+	if tools := requestTools(chatReq); len(tools) > 0 {
+		deepseekReq.Tools = tools
+		if tc := convertToolChoice(chatReq.ToolChoice); tc != "" {
+			deepseekReq.ToolChoice = tc
+		}
+	}
+
+	data, err := json.Marshal(deepseekReq)
+	return data, translation{}, err
+}
+
+func (b *deepseekBackend) Send(ctx context.Context, r *http.Request, body []byte, stream bool) (*http.Response, error) {
+	targetURL := b.endpoint + "/chat/completions"
+	if r.URL.RawQuery != "" {
+		targetURL += "?" + r.URL.RawQuery
+	}
+
+	log.Printf("Forwarding to: %s", targetURL)
+	proxyReq, err := http.NewRequestWithContext(ctx, http.MethodPost, targetURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	// Copy headers
+	copyHeaders(proxyReq.Header, r.Header)
+
+	// Set DeepSeek API key and content type
+	proxyReq.Header.Set("Authorization", "Bearer "+b.config.APIKey)
+	proxyReq.Header.Set("Content-Type", "application/json")
+	if stream {
+		proxyReq.Header.Set("Accept", "text/event-stream")
+	}
+
+	log.Printf("Proxy request headers: %v", proxyReq.Header)
+
+	return b.client.Do(proxyReq)
+}
+
+func (b *deepseekBackend) TranslateResponse(body []byte, tr translation, originalModel string) ([]byte, error) {
+	// Parse the DeepSeek response
+	var deepseekResp struct {
+		ID      string `json:"id"`
+		Object  string `json:"object"`
+		Created int64  `json:"created"`
+		Model   string `json:"model"`
+		Choices []struct {
+			Index        int     `json:"index"`
+			Message      Message `json:"message"`
+			FinishReason string  `json:"finish_reason"`
+		} `json:"choices"`
+		Usage Usage `json:"usage"`
+	}
+
+	if err := json.Unmarshal(body, &deepseekResp); err != nil {
+		return nil, err
+	}
+
+	// Convert to OpenAI format
+	openAIResp := struct {
+		ID      string `json:"id"`
+		Object  string `json:"object"`
+		Created int64  `json:"created"`
+		Model   string `json:"model"`
+		Choices []struct {
+			Index        int     `json:"index"`
+			Message      Message `json:"message"`
+			FinishReason string  `json:"finish_reason"`
+		} `json:"choices"`
+		Usage Usage `json:"usage"`
+	}{
+		ID:      deepseekResp.ID,
+		Object:  "chat.completion",
+		Created: deepseekResp.Created,
+		Model:   originalModel,
+		Usage:   deepseekResp.Usage,
+	}
+
+	// Convert choices and ensure tool calls are properly handled
+	openAIResp.Choices = make([]struct {
+		Index        int     `json:"index"`
+		Message      Message `json:"message"`
+		FinishReason string  `json:"finish_reason"`
+	}, len(deepseekResp.Choices))
+
+	for i, choice := range deepseekResp.Choices {
+		openAIResp.Choices[i].Index = choice.Index
+		openAIResp.Choices[i].Message = choice.Message
+		openAIResp.Choices[i].Message.ToolCalls = nil
+		applyReasoningPolicy(&openAIResp.Choices[i].Message, b.config.reasoningPolicy())
+		openAIResp.Choices[i].FinishReason = choice.FinishReason
+
+		// Ensure tool calls are properly formatted in the message
+		if len(choice.Message.ToolCalls) > 0 {
+			log.Printf("Processing %d tool calls in choice %d", len(choice.Message.ToolCalls), i)
+			for j, tc := range choice.Message.ToolCalls {
+				log.Printf("Tool call %d: %+v", j, tc)
+				// Ensure the tool call has the required fields
+				if tc.Function.Name == "" {
+					log.Printf("Warning: Empty function name in tool call %d", j)
+					continue
+				}
+				// Keep the tool call as is since it's already in the correct format
+				openAIResp.Choices[i].Message.ToolCalls = append(openAIResp.Choices[i].Message.ToolCalls, tc)
+			}
+		}
+	}
+
+	return json.Marshal(openAIResp)
+}
+
+func (b *deepseekBackend) TranslateStream(resp *http.Response, tr translation, originalModel string) streamSource {
+	log.Printf("Starting streaming response handling with model: %s", originalModel)
+	return newSSESource(resp.Body, newChunkRewriter(originalModel, reasoningTransform(b.config.reasoningPolicy())))
+}
@@ -3,249 +3,463 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
-	"os"
+	"strings"
+	"sync"
 	"time"
-
-	"github.com/joho/godotenv"
-	"golang.org/x/net/http2"
 )
 
 const (
 	ollamaEndpoint     = "http://localhost:11434/api"
-	defaultModel       = "llama2"
-	deepseekChatModel  = "michaelneale/deepseek-r1-goose"
-	deepseekCoderModel = "deepseek-coder"
-	gpt4oModel         = "gpt-4o"
+	defaultOllamaModel = "llama2"
+	ollamaR1Model      = "michaelneale/deepseek-r1-goose"
+
+	ollamaShowTimeout = 5 * time.Second
+)
+
+// How Ollama models get tools
+const (
+	toolsAuto   = "auto"   // native when /api/show lists the tools capability
+	toolsNative = "native" // always in the request
+	toolsPrompt = "prompt" // always described in the system prompt
 )
 
-// Configuration structure
-type Config struct {
-	endpoint string
-	model    string
+// Ollama specific structures
+type OllamaRequest struct {
+	Model       string          `json:"model"`
+	Messages    []OllamaMessage `json:"messages"`
+	Stream      bool            `json:"stream"`
+	Temperature *float64        `json:"temperature,omitempty"`
+	MaxTokens   int             `json:"max_tokens,omitempty"`
+	Tools       []Tool          `json:"tools,omitempty"`
+
+	// Format is "json" or a JSON schema the output is constrained to
+	Format json.RawMessage `json:"format,omitempty"`
 }
 
-var activeConfig Config
+// OllamaMessage is a chat message in Ollama's format, which carries images
+// as base64 data next to the text and names the tool of a tool result
+type OllamaMessage struct {
+	Role      string           `json:"role"`
+	Content   string           `json:"content"`
+	Images    []string         `json:"images,omitempty"`
+	ToolCalls []OllamaToolCall `json:"tool_calls,omitempty"`
+	ToolName  string           `json:"tool_name,omitempty"`
+}
 
-func init() {
-	// Load .env file
-	log.Printf("Variant: OLLAMA")
-	if err := godotenv.Load(); err != nil {
-		log.Printf("Warning: .env file not found or error loading it: %v", err)
-	}
+// OllamaToolCall is a native Ollama tool call. It has no id and its arguments
+// are a JSON object.
+type OllamaToolCall struct {
+	Function struct {
+		Name      string          `json:"name"`
+		Arguments json.RawMessage `json:"arguments"`
+	} `json:"function"`
+}
 
-	// Get custom Ollama endpoint if specified
-	customEndpoint := os.Getenv("OLLAMA_API_ENDPOINT")
-	if customEndpoint != "" {
-		activeConfig.endpoint = customEndpoint
-	} else {
-		activeConfig.endpoint = ollamaEndpoint
+// toolCallsFromOllama converts native Ollama tool calls to OpenAI ones with new ids.
+func toolCallsFromOllama(calls []OllamaToolCall) []ToolCall {
+	converted := make([]ToolCall, len(calls))
+	for i, call := range calls {
+		converted[i] = ToolCall{ID: newToolCallID(), Type: "function"}
+		converted[i].Function.Name = call.Function.Name
+		converted[i].Function.Arguments = toolArguments(call.Function.Arguments)
 	}
+	return converted
+}
 
-	// Get custom Ollama endpoint if specified
-	modelenv := os.Getenv("DEFAULT_MODEL")
-	if modelenv != "" {
-		activeConfig.model = modelenv
-	} else {
-		//no environment set so check for command line argument
-		modelFlag := defaultModel // default value
-		for i, arg := range os.Args {
-			if arg == "-model" && i+1 < len(os.Args) {
-				modelFlag = os.Args[i+1]
-			}
+// toolCallsToOllama converts OpenAI tool calls to Ollama's format.
+func toolCallsToOllama(calls []ToolCall) []OllamaToolCall {
+	converted := make([]OllamaToolCall, len(calls))
+	for i, call := range calls {
+		converted[i].Function.Name = call.Function.Name
+		args := json.RawMessage(call.Function.Arguments)
+		if !json.Valid(args) {
+			args = json.RawMessage("{}")
 		}
-		activeConfig.model = modelFlag
+		converted[i].Function.Arguments = args
 	}
-
-	log.Printf("Initialized with model: %s using endpoint: %s", activeConfig.model, activeConfig.endpoint)
+	return converted
 }
 
-// OpenAI compatible structures
-type ChatRequest struct {
-	Model       string      `json:"model"`
-	Messages    []Message   `json:"messages"`
-	Stream      bool        `json:"stream"`
-	Functions   []Function  `json:"functions,omitempty"`
-	Tools       []Tool      `json:"tools,omitempty"`
-	ToolChoice  interface{} `json:"tool_choice,omitempty"`
-	Temperature *float64    `json:"temperature,omitempty"`
-	MaxTokens   *int        `json:"max_tokens,omitempty"`
-}
+type OllamaResponse struct {
+	Model     string `json:"model"`
+	CreatedAt string `json:"created_at"`
+	Message   struct {
+		Role      string           `json:"role"`
+		Content   string           `json:"content"`
+		Thinking  string           `json:"thinking"` // separate reasoning of newer Ollama versions
+		ToolCalls []OllamaToolCall `json:"tool_calls"`
+	} `json:"message"`
+	Done bool `json:"done"`
 
-type Message struct {
-	Role       string     `json:"role"`
-	Content    string     `json:"content"`
-	ToolCalls  []ToolCall `json:"tool_calls,omitempty"`
-	ToolCallID string     `json:"tool_call_id,omitempty"`
-	Name       string     `json:"name,omitempty"`
+	// Token counts, reported with the final message
+	PromptEvalCount int `json:"prompt_eval_count"`
+	EvalCount       int `json:"eval_count"`
 }
 
-type Function struct {
-	Name        string `json:"name"`
-	Description string `json:"description"`
-	Parameters  any    `json:"parameters"`
+// usage converts Ollama's token counts, or returns nil when there are none.
+func (r *OllamaResponse) usage() *Usage {
+	if r.PromptEvalCount == 0 && r.EvalCount == 0 {
+		return nil
+	}
+	return &Usage{
+		PromptTokens:     r.PromptEvalCount,
+		CompletionTokens: r.EvalCount,
+		TotalTokens:      r.PromptEvalCount + r.EvalCount,
+	}
 }
 
-type Tool struct {
-	Type     string   `json:"type"`
-	Function Function `json:"function"`
-}
+type ollamaBackend struct {
+	config BackendConfig
+	client *http.Client
 
-type ToolCall struct {
-	ID       string `json:"id"`
-	Type     string `json:"type"`
-	Function struct {
-		Name      string `json:"name"`
-		Arguments string `json:"arguments"`
-	} `json:"function"`
+	// Whether each model supports native tools, as reported by /api/show
+	mu           sync.Mutex
+	capabilities map[string]bool
 }
 
-// Ollama specific structures
-type OllamaRequest struct {
-	Model       string    `json:"model"`
-	Messages    []Message `json:"messages"`
-	Stream      bool      `json:"stream"`
-	Temperature float64   `json:"temperature,omitempty"`
-	MaxTokens   int       `json:"max_tokens,omitempty"`
+func newOllamaBackend(cfg BackendConfig) (Backend, error) {
+	switch cfg.Tools {
+	case "", toolsAuto, toolsNative, toolsPrompt:
+	default:
+		return nil, fmt.Errorf("invalid tools mode %q, expected auto, native or prompt", cfg.Tools)
+	}
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = ollamaEndpoint
+	}
+	if cfg.Model == "" {
+		cfg.Model = defaultOllamaModel
+	}
+	return &ollamaBackend{
+		config:       cfg,
+		client:       &http.Client{},
+		capabilities: map[string]bool{},
+	}, nil
 }
 
-type OllamaResponse struct {
-	Model     string `json:"model"`
-	CreatedAt string `json:"created_at"`
-	Message   struct {
-		Role    string `json:"role"`
-		Content string `json:"content"`
-	} `json:"message"`
-	Done bool `json:"done"`
-}
+// nativeTools reports whether model takes tools in the request. In auto mode
+// Ollama is asked once per model; models it cannot tell about get the prompt.
+func (b *ollamaBackend) nativeTools(model string) bool {
+	switch b.config.Tools {
+	case toolsNative:
+		return true
+	case toolsPrompt:
+		return false
+	}
+
+	b.mu.Lock()
+	native, ok := b.capabilities[model]
+	b.mu.Unlock()
+	if ok {
+		return native
+	}
 
-func main() {
-	log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds | log.Lshortfile)
+	native, err := b.showTools(model)
+	if err != nil {
+		// Not cached, so the next request asks again
+		log.Printf("Error reading capabilities of Ollama model %s: %v", model, err)
+		return false
+	}
+	log.Printf("Ollama model %s native tool support: %v", model, native)
+	b.mu.Lock()
+	b.capabilities[model] = native
+	b.mu.Unlock()
+	return native
+}
 
-	server := &http.Server{
-		Addr:    ":9000",
-		Handler: http.HandlerFunc(proxyHandler),
+// showTools asks Ollama whether model has the tools capability.
+func (b *ollamaBackend) showTools(model string) (bool, error) {
+	body, _ := json.Marshal(map[string]string{"model": model})
+	ctx, cancel := context.WithTimeout(context.Background(), ollamaShowTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, b.config.Endpoint+"/show", bytes.NewReader(body))
+	if err != nil {
+		return false, err
 	}
+	req.Header.Set("Content-Type", "application/json")
 
-	// Enable HTTP/2 support
-	http2.ConfigureServer(server, &http2.Server{})
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("status %d", resp.StatusCode)
+	}
 
-	log.Printf("Starting Ollama proxy server on %s", server.Addr)
-	if err := server.ListenAndServe(); err != nil {
-		log.Fatalf("Server failed: %v", err)
+	var show struct {
+		Capabilities []string `json:"capabilities"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&show); err != nil {
+		return false, err
+	}
+	for _, c := range show.Capabilities {
+		if c == "tools" {
+			return true, nil
+		}
 	}
+	return false, nil
 }
 
-func enableCors(w http.ResponseWriter) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Origin, Content-Type, Accept, Authorization")
-	w.Header().Set("Access-Control-Expose-Headers", "Content-Length")
-	w.Header().Set("Access-Control-Allow-Credentials", "true")
+func (b *ollamaBackend) Name() string { return "ollama" }
+
+func (b *ollamaBackend) DefaultModel() string { return b.config.Model }
+
+func (b *ollamaBackend) NeedsImageData() bool { return b.config.acceptsImages(true) }
+
+func (b *ollamaBackend) NativeToolChoice() bool { return false }
+
+func (b *ollamaBackend) Models() []Model {
+	return []Model{
+		{
+			ID:      b.config.Model,
+			Object:  "model",
+			Created: time.Now().Unix(),
+			OwnedBy: "ollama",
+		},
+	}
 }
 
-func proxyHandler(w http.ResponseWriter, r *http.Request) {
-	log.Printf("Received request: %s %s", r.Method, r.URL.Path)
+func (b *ollamaBackend) TranslateRequest(chatReq *ChatRequest, model string) ([]byte, translation, error) {
+	// Tools go to models that support them natively and are described in
+	// the system prompt for the others
+	var tools []Tool
+	if chatReq.ToolChoice != "none" {
+		tools = requestTools(chatReq)
+	}
+	emulateTools := len(tools) > 0 && !b.nativeTools(model)
 
-	if r.Method == "OPTIONS" {
-		enableCors(w)
-		return
+	// Convert to Ollama request format
+	messages, err := b.convertMessages(chatReq.Messages, emulateTools)
+	if err != nil {
+		return nil, translation{}, err
+	}
+	if emulateTools {
+		messages = withSystemPrompt(messages, toolSystemPrompt(tools))
+	}
+	ollamaReq := OllamaRequest{
+		Model:    model,
+		Messages: messages,
+		Stream:   chatReq.Stream,
+	}
+	if !emulateTools {
+		ollamaReq.Tools = tools
+	}
+	if rf := chatReq.ResponseFormat; rf.jsonMode() {
+		ollamaReq.Format = json.RawMessage(`"json"`)
+		if schema := rf.schema(); len(schema) > 0 {
+			ollamaReq.Format = schema
+		}
+		// Models follow the format better when the prompt asks for it too
+		ollamaReq.Messages = withSystemPrompt(ollamaReq.Messages, rf.instruction())
 	}
 
-	enableCors(w)
+	b.config.applyDefaults(&ollamaReq.Temperature, &ollamaReq.MaxTokens, chatReq)
 
-	switch r.URL.Path {
-	case "/v1/chat/completions":
-		handleChatCompletions(w, r)
-	case "/v1/models":
-		handleModelsRequest(w)
-	default:
-		http.Error(w, "Not found", http.StatusNotFound)
+	data, err := json.Marshal(ollamaReq)
+	return data, translation{emulateTools: emulateTools}, err
+}
+
+// convertMessages converts messages to Ollama's format. Image parts become
+// base64 images unless vision is disabled. Tool results are matched to the
+// name of their call, which is what Ollama needs. With emulated tools,
+// earlier tool calls are written out as the model was told to write them and
+// tool results become user messages.
+func (b *ollamaBackend) convertMessages(messages []Message, emulateTools bool) ([]OllamaMessage, error) {
+	vision := b.config.acceptsImages(true)
+	converted := make([]OllamaMessage, len(messages))
+	toolNames := map[string]string{}
+	for i, msg := range messages {
+		for _, call := range msg.ToolCalls {
+			toolNames[call.ID] = call.Function.Name
+		}
+		converted[i] = OllamaMessage{
+			Role:    msg.Role,
+			Content: msg.Content,
+		}
+
+		switch {
+		case emulateTools && msg.Role == "assistant" && len(msg.ToolCalls) > 0:
+			converted[i].Content = toolCallsText(msg.ToolCalls)
+		case emulateTools && msg.Role == "tool":
+			converted[i].Role = "user"
+			converted[i].Content = toolResultText(toolNames[msg.ToolCallID], msg.ToolCallID, msg.Content)
+		case emulateTools && msg.Role == "function":
+			converted[i].Role = "user"
+			converted[i].Content = toolResultText(msg.Name, "", msg.Content)
+		case msg.Role == "assistant":
+			if len(msg.ToolCalls) > 0 {
+				converted[i].ToolCalls = toolCallsToOllama(msg.ToolCalls)
+			}
+		case msg.Role == "tool":
+			converted[i].ToolName = toolNames[msg.ToolCallID]
+		case msg.Role == "function":
+			converted[i].Role = "tool"
+			converted[i].ToolName = msg.Name
+		}
+
+		if !vision {
+			continue
+		}
+		for _, image := range msg.images() {
+			data, err := imageBase64(image.URL)
+			if err != nil {
+				return nil, fmt.Errorf("message %d: %v", i, err)
+			}
+			converted[i].Images = append(converted[i].Images, data)
+		}
 	}
+	return converted, nil
 }
 
-func handleChatCompletions(w http.ResponseWriter, r *http.Request) {
-	var chatReq ChatRequest
-	if err := json.NewDecoder(r.Body).Decode(&chatReq); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
+// withSystemPrompt adds prompt to the leading system message, or prepends
+// one.
+func withSystemPrompt(messages []OllamaMessage, prompt string) []OllamaMessage {
+	if len(messages) > 0 && messages[0].Role == "system" {
+		messages[0].Content = strings.TrimSpace(messages[0].Content + "\n\n" + prompt)
+		return messages
 	}
+	return append([]OllamaMessage{{Role: "system", Content: prompt}}, messages...)
+}
 
-	// Store original model name for response
-	originalModel := chatReq.Model
-	if originalModel == "" {
-		originalModel = activeConfig.model
+func (b *ollamaBackend) Send(ctx context.Context, r *http.Request, body []byte, stream bool) (*http.Response, error) {
+	targetURL := fmt.Sprintf("%s/chat", b.config.Endpoint)
+
+	log.Printf("Forwarding to: %s", targetURL)
+	proxyReq, err := http.NewRequestWithContext(ctx, http.MethodPost, targetURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
 	}
+	proxyReq.Header.Set("Content-Type", "application/json")
 
-	// Always use the configured model internally
-	chatReq.Model = activeConfig.model
-	log.Printf("Model converted to: %s (original: %s)", activeConfig.model, originalModel)
+	return b.client.Do(proxyReq)
+}
 
-	// Convert to Ollama request format
-	ollamaReq := OllamaRequest{
-		Model:    activeConfig.model,
-		Messages: chatReq.Messages,
-		Stream:   chatReq.Stream,
+func (b *ollamaBackend) TranslateResponse(body []byte, tr translation, originalModel string) ([]byte, error) {
+	var ollamaResp OllamaResponse
+	if err := json.Unmarshal(body, &ollamaResp); err != nil {
+		return nil, err
 	}
 
-	if chatReq.Temperature != nil {
-		ollamaReq.Temperature = *chatReq.Temperature
+	message := map[string]interface{}{
+		"role":    "assistant",
+		"content": ollamaResp.Message.Content,
 	}
-	if chatReq.MaxTokens != nil {
-		ollamaReq.MaxTokens = *chatReq.MaxTokens
+	if b.config.reasoningPolicy() != reasoningThink {
+		content, reasoning := splitThink(ollamaResp.Message.Content)
+		b.setReasoning(message, content, ollamaResp.Message.Thinking+reasoning)
 	}
 
-	// Create Ollama request
-	ollamaReqBody, err := json.Marshal(ollamaReq)
-	if err != nil {
-		log.Printf("ERROR: failed to marshal ollama request: %s", err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	// Native tool calls, or one written as the tool prompt asked
+	finishReason := "stop"
+	content, _ := message["content"].(string)
+	calls := toolCallsFromOllama(ollamaResp.Message.ToolCalls)
+	if len(calls) == 0 && tr.emulateTools {
+		if parsed, ok := parseToolCallText(content); ok {
+			calls, content = parsed, ""
+		}
+	}
+	if len(calls) > 0 {
+		message["tool_calls"] = calls
+		if content == "" {
+			message["content"] = nil
+		}
+		finishReason = "tool_calls"
 	}
 
-	// Send request to Ollama
-	ollamaResp, err := http.Post(
-		fmt.Sprintf("%s/chat", activeConfig.endpoint),
-		"application/json",
-		bytes.NewBuffer(ollamaReqBody),
-	)
-	if err != nil {
-		log.Printf("ERROR: POST failed: %s", err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	// Kept reasoning of newer Ollama versions, which answer it separately,
+	// goes into the content as a <think> block
+	if thinking := ollamaResp.Message.Thinking; thinking != "" && b.config.reasoningPolicy() == reasoningThink {
+		msg := Message{Content: content, ReasoningContent: thinking}
+		applyReasoningPolicy(&msg, reasoningThink)
+		message["content"] = msg.Content
 	}
-	defer ollamaResp.Body.Close()
 
-	if chatReq.Stream {
-		handleStreamingResponse(w, r, ollamaResp, originalModel)
-	} else {
-		handleRegularResponse(w, ollamaResp, originalModel)
+	// Convert to OpenAI format
+	openAIResp := map[string]interface{}{
+		"id":      "chatcmpl-" + time.Now().Format("20060102150405"),
+		"object":  "chat.completion",
+		"created": time.Now().Unix(),
+		"model":   originalModel,
+		"choices": []map[string]interface{}{
+			{
+				"index":         0,
+				"message":       message,
+				"finish_reason": finishReason,
+			},
+		},
 	}
+	if usage := ollamaResp.usage(); usage != nil {
+		openAIResp["usage"] = usage
+	}
+
+	return json.Marshal(openAIResp)
 }
 
-func handleStreamingResponse(w http.ResponseWriter, r *http.Request, resp *http.Response, originalModel string) {
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
+func (b *ollamaBackend) TranslateStream(resp *http.Response, tr translation, originalModel string) streamSource {
+	src := &ollamaStreamSource{
+		backend: b,
+		reader:  bufio.NewReader(resp.Body),
+		model:   originalModel,
+		id:      "chatcmpl-" + time.Now().Format("20060102150405"),
+	}
 
-	flusher, ok := w.(http.Flusher)
-	if !ok {
-		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
-		return
+	// Inline <think> blocks are split off unless they are kept, in which
+	// case separate reasoning is written into the content
+	if b.config.reasoningPolicy() != reasoningThink {
+		src.think = &thinkParser{}
+	} else {
+		src.inlineThinking = true
+	}
+	// Only answers to the tool prompt may hold a tool call written as text
+	if tr.emulateTools {
+		src.tools = &toolCallDetector{}
 	}
+	return src
+}
+
+// ollamaStreamSource converts Ollama's NDJSON stream into OpenAI chunks.
+type ollamaStreamSource struct {
+	backend   *ollamaBackend
+	reader    *bufio.Reader
+	think     *thinkParser
+	tools     *toolCallDetector
+	toolCalls int // tool calls sent so far
+	model     string
+	id        string
+	done      bool
+	usage     *sseEvent // usage chunk that follows the final chunk
+
+	inlineThinking bool // write separate reasoning into a <think> block
+	thinking       bool // the <think> block is open
+}
 
-	reader := bufio.NewReader(resp.Body)
+func (s *ollamaStreamSource) next() (*sseEvent, error) {
 	for {
-		line, err := reader.ReadBytes('\n')
-		if err != nil {
-			if err != io.EOF {
-				log.Printf("Error reading stream: %v", err)
+		if s.usage != nil {
+			ev := s.usage
+			s.usage = nil
+			return ev, nil
+		}
+		if s.done {
+			return nil, io.EOF
+		}
+
+		line, err := s.reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) == 0 {
+			if err == io.EOF {
+				// The final message has done set
+				return nil, io.ErrUnexpectedEOF
 			}
-			break
+			if err != nil {
+				return nil, err
+			}
+			continue
 		}
 
 		var ollamaResp OllamaResponse
@@ -253,97 +467,101 @@ func handleStreamingResponse(w http.ResponseWriter, r *http.Request, resp *http.
 			log.Printf("Error unmarshaling response: %v", err)
 			continue
 		}
+		s.done = ollamaResp.Done
+
+		delta := map[string]interface{}{
+			"role":    "assistant",
+			"content": ollamaResp.Message.Content,
+		}
+		if s.think != nil {
+			content, reasoning := s.think.feed(ollamaResp.Message.Content)
+			if ollamaResp.Done {
+				c, r := s.think.flush()
+				content, reasoning = content+c, reasoning+r
+			}
+			s.backend.setReasoning(delta, content, ollamaResp.Message.Thinking+reasoning)
+		}
+
+		// Hold back what may be a tool call written as the tool prompt asked
+		calls := toolCallsFromOllama(ollamaResp.Message.ToolCalls)
+		if s.tools != nil {
+			content, _ := delta["content"].(string)
+			content = s.tools.feed(content)
+			if ollamaResp.Done {
+				rest, parsed := s.tools.flush()
+				content += rest
+				calls = append(calls, parsed...)
+			}
+			delta["content"] = content
+		}
+		if s.inlineThinking {
+			content, _ := delta["content"].(string)
+			delta["content"] = s.inlineThink(ollamaResp.Message.Thinking, content, ollamaResp.Done || len(calls) > 0)
+		}
+		if len(calls) > 0 {
+			delta["tool_calls"] = toolCallDeltas(calls, s.toolCalls)
+			s.toolCalls += len(calls)
+		}
 
 		// Convert to OpenAI format
 		openAIResp := map[string]interface{}{
-			"id":      "chatcmpl-" + time.Now().Format("20060102150405"),
+			"id":      s.id,
 			"object":  "chat.completion.chunk",
 			"created": time.Now().Unix(),
-			"model":   originalModel,
+			"model":   s.model,
 			"choices": []map[string]interface{}{
 				{
-					"index": 0,
-					"delta": map[string]interface{}{
-						"role":    "assistant",
-						"content": ollamaResp.Message.Content,
-					},
+					"index":         0,
+					"delta":         delta,
 					"finish_reason": nil,
 				},
 			},
 		}
 
 		if ollamaResp.Done {
-			openAIResp["choices"].([]map[string]interface{})[0]["finish_reason"] = "stop"
-		}
-
-		if data, err := json.Marshal(openAIResp); err == nil {
-			fmt.Fprintf(w, "data: %s\n\n", data)
-			flusher.Flush()
+			finishReason := "stop"
+			if s.toolCalls > 0 {
+				finishReason = "tool_calls"
+			}
+			openAIResp["choices"].([]map[string]interface{})[0]["finish_reason"] = finishReason
+			if usage := ollamaResp.usage(); usage != nil {
+				s.usage = newUsageChunk(s.id, openAIResp["created"].(int64), s.model, usage)
+			}
 		}
 
-		if ollamaResp.Done {
-			break
+		data, err := json.Marshal(openAIResp)
+		if err != nil {
+			return nil, err
 		}
+		return &sseEvent{data: data, hasData: true}, nil
 	}
 }
 
-func handleRegularResponse(w http.ResponseWriter, resp *http.Response, originalModel string) {
-	var ollamaResp OllamaResponse
-	if err := json.NewDecoder(resp.Body).Decode(&ollamaResp); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+// inlineThink puts the separate reasoning of a stream into the content, as
+// reasoningTransform does for DeepSeek: a <think> block opens with the first
+// reasoning and closes before the first content or at the end.
+func (s *ollamaStreamSource) inlineThink(thinking, content string, end bool) string {
+	var b strings.Builder
+	if thinking != "" {
+		if !s.thinking {
+			s.thinking = true
+			b.WriteString(thinkOpenTag + "\n")
+		}
+		b.WriteString(thinking)
 	}
-
-	// Convert to OpenAI format
-	openAIResp := map[string]interface{}{
-		"id":      "chatcmpl-" + time.Now().Format("20060102150405"),
-		"object":  "chat.completion",
-		"created": time.Now().Unix(),
-		"model":   originalModel,
-		"choices": []map[string]interface{}{
-			{
-				"index": 0,
-				"message": map[string]interface{}{
-					"role":    "assistant",
-					"content": ollamaResp.Message.Content,
-				},
-				"finish_reason": "stop",
-			},
-		},
+	if s.thinking && (content != "" || end) {
+		s.thinking = false
+		b.WriteString("\n" + thinkCloseTag + "\n\n")
 	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(openAIResp)
+	b.WriteString(content)
+	return b.String()
 }
 
-func handleModelsRequest(w http.ResponseWriter) {
-	log.Printf("Handling models request")
-	
-	response := ModelsResponse{
-		Object: "list",
-		Data: []Model{
-			{
-				ID:      activeConfig.model,
-				Object:  "model",
-				Created: time.Now().Unix(),
-				OwnedBy: "ollama",
-			},
-		},
+// setReasoning stores the answer and, unless reasoning is dropped, the
+// reasoning split off from it in an OpenAI message or delta.
+func (b *ollamaBackend) setReasoning(message map[string]interface{}, content, reasoning string) {
+	message["content"] = content
+	if reasoning != "" && b.config.reasoningPolicy() == reasoningPassthrough {
+		message["reasoning_content"] = reasoning
 	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
-	log.Printf("Models response sent successfully")
-}
-
-type ModelsResponse struct {
-	Object string  `json:"object"`
-	Data   []Model `json:"data"`
-}
-
-type Model struct {
-	ID      string `json:"id"`
-	Object  string `json:"object"`
-	Created int64  `json:"created"`
-	OwnedBy string `json:"owned_by"`
 }
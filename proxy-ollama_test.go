@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestOllamaSeparateThinking(t *testing.T) {
+	ndjson := `{"message":{"role":"assistant","thinking":"Let me "}}
+{"message":{"role":"assistant","thinking":"think."}}
+{"message":{"role":"assistant","content":"Answer"}}
+{"message":{"role":"assistant","content":""},"done":true}
+`
+	whole := `{"message":{"role":"assistant","thinking":"Let me think.","content":"Answer"},"done":true}`
+
+	tests := []struct {
+		policy    string
+		content   string
+		reasoning string
+	}{
+		{reasoningThink, "<think>\nLet me think.\n</think>\n\nAnswer", ""},
+		{reasoningPassthrough, "Answer", "Let me think."},
+		{reasoningDrop, "Answer", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			b, err := newOllamaBackend(BackendConfig{Reasoning: tt.policy})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			resp := &http.Response{Body: io.NopCloser(strings.NewReader(ndjson))}
+			completion, err := aggregateStream(b.TranslateStream(resp, translation{}, "llama"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkAnswer(t, "stream", completion, tt.content, tt.reasoning)
+
+			translated, err := b.TranslateResponse([]byte(whole), translation{}, "llama")
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkAnswer(t, "response", translated, tt.content, tt.reasoning)
+		})
+	}
+}
+
+func checkAnswer(t *testing.T, what string, body []byte, content, reasoning string) {
+	t.Helper()
+	var completion chatCompletion
+	if err := json.Unmarshal(body, &completion); err != nil {
+		t.Fatalf("%s: %v", what, err)
+	}
+	msg := completion.Choices[0].Message
+	if msg.Content != content || msg.ReasoningContent != reasoning {
+		t.Errorf("%s: content %q, reasoning %q, want %q, %q", what, msg.Content, msg.ReasoningContent, content, reasoning)
+	}
+}
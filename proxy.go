@@ -1,226 +1,81 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
-	"compress/flate"
-	"compress/gzip"
 	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
-	"strings"
 	"time"
 
-	"github.com/andybalholm/brotli"
 	"github.com/joho/godotenv"
 	"golang.org/x/net/http2"
 )
 
-const (
-	deepseekEndpoint     = "https://api.deepseek.com"
-	deepseekBetaEndpoint = "https://api.deepseek.com/beta"
-	deepseekChatModel    = "deepseek-chat"
-	deepseekCoderModel   = "deepseek-coder"
-	gpt4oModel           = "gpt-4o"
-)
-
-var deepseekAPIKey string
-
-// Configuration structure
-type Config struct {
-	endpoint string
-	model    string
-}
-
-var activeConfig Config
+func main() {
+	log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds | log.Lshortfile)
 
-func init() {
 	// Load .env file
 	if err := godotenv.Load(); err != nil {
 		log.Printf("Warning: .env file not found or error loading it: %v", err)
 	}
 
-	// Get DeepSeek API key
-	deepseekAPIKey = os.Getenv("DEEPSEEK_API_KEY")
-	if deepseekAPIKey == "" {
-		log.Fatal("DEEPSEEK_API_KEY environment variable is required")
-	}
-
 	// Parse command line arguments
-	modelFlag := "chat" // default value
-	for i, arg := range os.Args {
-		if arg == "-model" && i+1 < len(os.Args) {
-			modelFlag = os.Args[i+1]
-		}
-	}
-
-	// Configure the active endpoint and model based on the flag
-	switch modelFlag {
-	case "coder":
-		activeConfig = Config{
-			endpoint: deepseekBetaEndpoint,
-			model:    deepseekCoderModel,
-		}
-	case "chat":
-		activeConfig = Config{
-			endpoint: deepseekEndpoint,
-			model:    deepseekChatModel,
-		}
-	default:
-		log.Printf("Invalid model specified: %s. Using default chat model.", modelFlag)
-		activeConfig = Config{
-			endpoint: deepseekEndpoint,
-			model:    deepseekChatModel,
+	var flags configFlags
+	flag.StringVar(&flags.path, "config", os.Getenv("CONFIG_FILE"), "path to the YAML config file (default "+defaultConfigPath+")")
+	flag.StringVar(&flags.listen, "listen", "", "listen address, overrides the config file")
+	flag.StringVar(&flags.backend, "backend", "", "default backend: deepseek, openrouter or ollama")
+	flag.StringVar(&flags.model, "model", "", "model for the default backend (for DeepSeek: chat or coder)")
+	flag.StringVar(&flags.routes, "routes", "", "model routes, e.g. gpt-4o=deepseek:deepseek-chat|ollama,*=deepseek")
+	generateKey := flag.Bool("generate-key", false, "print a new client access key and exit")
+	usageReport := flag.Bool("usage", false, "print usage totals from the ledger and exit")
+	usageGroupBy := flag.String("group-by", "", "usage report grouping: day, client, model, upstream_model, backend")
+	usageSince := flag.String("since", "", "usage report start date (YYYY-MM-DD)")
+	usageUntil := flag.String("until", "", "usage report end date (YYYY-MM-DD, inclusive)")
+	usageClient := flag.String("client", "", "usage report client filter")
+	flag.Parse()
+
+	if *generateKey {
+		key, err := generateClientKey()
+		if err != nil {
+			log.Fatalf("Error generating client key: %v", err)
 		}
+		fmt.Println(key)
+		return
 	}
-
-	log.Printf("Initialized with model: %s using endpoint: %s", activeConfig.model, activeConfig.endpoint)
-}
-
-// Models response structure
-type ModelsResponse struct {
-	Object string  `json:"object"`
-	Data   []Model `json:"data"`
-}
-
-type Model struct {
-	ID      string `json:"id"`
-	Object  string `json:"object"`
-	Created int64  `json:"created"`
-	OwnedBy string `json:"owned_by"`
-}
-
-// OpenAI compatible request structure
-type ChatRequest struct {
-	Model       string      `json:"model"`
-	Messages    []Message   `json:"messages"`
-	Stream      bool        `json:"stream"`
-	Functions   []Function  `json:"functions,omitempty"`
-	Tools       []Tool      `json:"tools,omitempty"`
-	ToolChoice  interface{} `json:"tool_choice,omitempty"`
-	Temperature *float64    `json:"temperature,omitempty"`
-	MaxTokens   *int        `json:"max_tokens,omitempty"`
-}
-
-type Message struct {
-	Role       string     `json:"role"`
-	Content    string     `json:"content"`
-	ToolCalls  []ToolCall `json:"tool_calls,omitempty"`
-	ToolCallID string     `json:"tool_call_id,omitempty"`
-	Name       string     `json:"name,omitempty"`
-}
-
-type Function struct {
-	Name        string `json:"name"`
-	Description string `json:"description"`
-	Parameters  any    `json:"parameters"`
-}
-
-type Tool struct {
-	Type     string   `json:"type"`
-	Function Function `json:"function"`
-}
-
-type ToolCall struct {
-	ID       string `json:"id"`
-	Type     string `json:"type"`
-	Function struct {
-		Name      string `json:"name"`
-		Arguments string `json:"arguments"`
-	} `json:"function"`
-}
-
-func convertToolChoice(choice interface{}) string {
-	if choice == nil {
-		return ""
-	}
-
-	// If string "auto" or "none"
-	if str, ok := choice.(string); ok {
-		switch str {
-		case "auto", "none":
-			return str
-		}
+	if flags.path == "" {
+		flags.path = defaultConfigPath
 	}
 
-	// Try to parse as map for function call
-	if choiceMap, ok := choice.(map[string]interface{}); ok {
-		if choiceMap["type"] == "function" {
-			return "auto" // DeepSeek doesn't support specific function selection, default to auto
-		}
+	if err := reloadConfig(flags); err != nil {
+		log.Fatalf("Error loading config: %v", err)
 	}
 
-	return ""
-}
-
-func convertMessages(messages []Message) []Message {
-	converted := make([]Message, len(messages))
-	for i, msg := range messages {
-		log.Printf("Converting message %d - Role: %s", i, msg.Role)
-		converted[i] = msg
-
-		// Handle assistant messages with tool calls
-		if msg.Role == "assistant" && len(msg.ToolCalls) > 0 {
-			log.Printf("Processing assistant message with %d tool calls", len(msg.ToolCalls))
-			// DeepSeek expects tool_calls in a specific format
-			toolCalls := make([]ToolCall, len(msg.ToolCalls))
-			for j, tc := range msg.ToolCalls {
-				toolCalls[j] = ToolCall{
-					ID:       tc.ID,
-					Type:     "function",
-					Function: tc.Function,
-				}
-				log.Printf("Tool call %d - ID: %s, Function: %s", j, tc.ID, tc.Function.Name)
-			}
-			converted[i].ToolCalls = toolCalls
-		}
-
-		// Handle function response messages
-		if msg.Role == "function" {
-			log.Printf("Converting function response to tool response")
-			// Convert to tool response format
-			converted[i].Role = "tool"
+	if *usageReport {
+		q, err := parseUsageQuery(func(name string) string {
+			return map[string]string{
+				"group_by": *usageGroupBy,
+				"since":    *usageSince,
+				"until":    *usageUntil,
+				"client":   *usageClient,
+			}[name]
+		})
+		if err != nil {
+			log.Fatalf("Invalid usage query: %v", err)
 		}
-	}
-
-	// Log the final converted messages
-	for i, msg := range converted {
-		log.Printf("Final message %d - Role: %s, Content: %s", i, msg.Role, truncateString(msg.Content, 50))
-		if len(msg.ToolCalls) > 0 {
-			log.Printf("Message %d has %d tool calls", i, len(msg.ToolCalls))
+		if err := printUsageReport(os.Stdout, currentState().config.Ledger.Path, q); err != nil {
+			log.Fatalf("Error reading usage ledger: %v", err)
 		}
+		return
 	}
-
-	return converted
-}
-
-func truncateString(s string, maxLen int) string {
-	if len(s) <= maxLen {
-		return s
-	}
-	return s[:maxLen] + "..."
-}
-
-// DeepSeek request structure
-type DeepSeekRequest struct {
-	Model       string    `json:"model"`
-	Messages    []Message `json:"messages"`
-	Stream      bool      `json:"stream"`
-	Temperature float64   `json:"temperature,omitempty"`
-	MaxTokens   int       `json:"max_tokens,omitempty"`
-	Tools       []Tool    `json:"tools,omitempty"`
-	ToolChoice  string    `json:"tool_choice,omitempty"`
-}
-
-func main() {
-	log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds | log.Lshortfile)
+	go watchConfig(flags)
 
 	server := &http.Server{
-		Addr:    ":9000",
+		Addr:    currentState().config.Listen,
 		Handler: http.HandlerFunc(proxyHandler),
 	}
 
@@ -236,13 +91,14 @@ func main() {
 func enableCors(w http.ResponseWriter) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Origin, Content-Type, Accept, Authorization")
-	w.Header().Set("Access-Control-Expose-Headers", "Content-Length")
+	w.Header().Set("Access-Control-Allow-Headers", "Origin, Content-Type, Accept, Authorization, "+cacheControlHeader)
+	w.Header().Set("Access-Control-Expose-Headers", "Content-Length, "+costHeader+", "+cacheStatusHeader)
 	w.Header().Set("Access-Control-Allow-Credentials", "true")
 }
 
 func proxyHandler(w http.ResponseWriter, r *http.Request) {
 	log.Printf("Received request: %s %s", r.Method, r.URL.Path)
+	start := time.Now()
 
 	if r.Method == "OPTIONS" {
 		enableCors(w)
@@ -251,31 +107,45 @@ func proxyHandler(w http.ResponseWriter, r *http.Request) {
 
 	enableCors(w)
 
-	// Validate API key
-	authHeader := r.Header.Get("Authorization")
-	if !strings.HasPrefix(authHeader, "Bearer ") {
-		log.Printf("Missing or invalid Authorization header")
-		http.Error(w, "Missing or invalid Authorization header", http.StatusUnauthorized)
-		return
-	}
+	// Use one config snapshot for the whole request
+	st := currentState()
 
-	userAPIKey := strings.TrimPrefix(authHeader, "Bearer ")
-	if userAPIKey != deepseekAPIKey {
-		log.Printf("Invalid API key provided")
-		http.Error(w, "Invalid API key", http.StatusUnauthorized)
+	client, ok := st.authenticate(w, r)
+	if !ok {
 		return
 	}
+	log.Printf("Authenticated client: %s", client.name)
 
 	// Handle /v1/models endpoint
 	if r.URL.Path == "/v1/models" && r.Method == "GET" {
 		log.Printf("Handling /v1/models request")
-		handleModelsRequest(w)
+		handleModelsRequest(w, st.router)
+		return
+	}
+
+	// Handle /v1/usage endpoint
+	if r.URL.Path == "/v1/usage" && r.Method == "GET" {
+		log.Printf("Handling /v1/usage request")
+		handleUsageRequest(w, r, st, client)
+		return
+	}
+
+	// Only handle chat completions API requests
+	if r.URL.Path != "/v1/chat/completions" {
+		log.Printf("Invalid path: %s", r.URL.Path)
+		http.Error(w, "Not found", http.StatusNotFound)
 		return
 	}
 
 	// Log headers for debugging
 	log.Printf("Request headers: %+v", r.Header)
 
+	// A client reconnecting to a stream picks up where it left off
+	if id := r.Header.Get(lastEventIDHeader); id != "" && st.config.Resume.Enabled {
+		resumeStream(w, r, client, id)
+		return
+	}
+
 	// Read and log request body for debugging
 	var chatReq ChatRequest
 	body, err := io.ReadAll(r.Body)
@@ -284,7 +154,6 @@ func proxyHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Error reading request", http.StatusBadRequest)
 		return
 	}
-	r.Body = io.NopCloser(bytes.NewBuffer(body))
 
 	if err := json.Unmarshal(body, &chatReq); err != nil {
 		log.Printf("Error parsing request JSON: %v", err)
@@ -293,132 +162,176 @@ func proxyHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	log.Printf("Parsed request: %+v", chatReq)
-
-	// Handle models endpoint
-	if r.URL.Path == "/v1/models" {
-		handleModelsRequest(w)
-		return
-	}
-
-	// Only handle API requests with /v1/ prefix
-	if !strings.HasPrefix(r.URL.Path, "/v1/") {
-		log.Printf("Invalid path: %s", r.URL.Path)
-		http.Error(w, "Not found", http.StatusNotFound)
-		return
-	}
-
-	// Restore the body for further reading
-	r.Body = io.NopCloser(bytes.NewBuffer(body))
-
 	log.Printf("Request body: %s", string(body))
+	log.Printf("Requested model: %s", chatReq.Model)
+	chatReq.images = newImageCache(st.config.Images)
 
-	// Parse the request to check for streaming - reuse existing chatReq
-	if err := json.Unmarshal(body, &chatReq); err != nil {
-		log.Printf("Error parsing request JSON: %v", err)
-		http.Error(w, "Error parsing request", http.StatusBadRequest)
+	// Answers in JSON mode are validated before the client sees them
+	jsonFormat, err := parseJSONFormatCheck(&chatReq)
+	if err != nil {
+		log.Printf("Invalid response_format: %v", err)
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "invalid_response_format", err.Error())
 		return
 	}
 
-	log.Printf("Requested model: %s", chatReq.Model)
+	targets := st.router.Resolve(chatReq.Model)
 
 	// Store original model name for response
 	originalModel := chatReq.Model
-	
-	// Convert to deepseek-chat internally
-	chatReq.Model = deepseekChatModel
-	log.Printf("Model converted to: %s (original: %s)", deepseekChatModel, originalModel)
-
-	// Convert to DeepSeek request format
-	deepseekReq := DeepSeekRequest{
-		Model:    deepseekChatModel,
-		Messages: convertMessages(chatReq.Messages),
-		Stream:   chatReq.Stream,
+	if originalModel == "" {
+		originalModel = targets[0].model
 	}
 
-	// Copy optional parameters if present
-	if chatReq.Temperature != nil {
-		deepseekReq.Temperature = *chatReq.Temperature
-	}
-	if chatReq.MaxTokens != nil {
-		deepseekReq.MaxTokens = *chatReq.MaxTokens
+	rec := UsageRecord{
+		Time:           start.UTC(),
+		Client:         client.name,
+		RequestedModel: originalModel,
+		Stream:         chatReq.Stream,
 	}
 
-	// Handle tools/functions
-	if len(chatReq.Tools) > 0 {
-		deepseekReq.Tools = chatReq.Tools
-		if tc := convertToolChoice(chatReq.ToolChoice); tc != "" {
-			deepseekReq.ToolChoice = tc
-		}
-	} else if len(chatReq.Functions) > 0 {
-		// Convert functions to tools format
-		tools := make([]Tool, len(chatReq.Functions))
-		for i, fn := range chatReq.Functions {
-			tools[i] = Tool{
-				Type:     "function",
-				Function: fn,
+	// Serve repeated deterministic requests from the response cache
+	var cacheKey string
+	if st.config.Cache.Enabled && wantsCache(r, &chatReq) {
+		cacheKey = responseCacheKey(&chatReq, targets)
+		if entry, ok := responses.get(cacheKey); ok {
+			if chatReq.Stream {
+				replayCachedStream(w, r, entry, st.config.Cache.ReplayInterval)
+			} else {
+				serveCachedResponse(w, entry)
 			}
+			rec.Backend = entry.backend
+			rec.UpstreamModel = entry.model
+			rec.Status = http.StatusOK
+			rec.CacheHit = true
+			recordUsage(st, rec, &chatReq, completionResult{usage: &Usage{}, finishReason: entry.finishReason}, start)
+			return
 		}
-		deepseekReq.Tools = tools
-
-		// Convert tool_choice if present
-		if tc := convertToolChoice(chatReq.ToolChoice); tc != "" {
-			deepseekReq.ToolChoice = tc
-		}
+		w.Header().Set(cacheStatusHeader, "MISS")
 	}
 
-	// Create new request body
-	modifiedBody, err := json.Marshal(deepseekReq)
-	if err != nil {
-		log.Printf("Error creating modified request body: %v", err)
-		http.Error(w, "Error creating modified request", http.StatusInternalServerError)
+	// Enforce the spending budgets of the client and the backends
+	targets, overBudget := st.applyBudgets(client, targets)
+	if overBudget != nil {
+		log.Printf("Budget exhausted for %s %s", overBudget.scope, overBudget.name)
+		writeOpenAIError(w, http.StatusTooManyRequests, "insufficient_quota", "insufficient_quota", overBudget.message())
 		return
 	}
 
-	log.Printf("Modified request body: %s", string(modifiedBody))
-
-	// Create the proxy request to DeepSeek
-	targetURL := activeConfig.endpoint + r.URL.Path
-	if r.URL.RawQuery != "" {
-		targetURL += "?" + r.URL.RawQuery
-	}
-
-	log.Printf("Forwarding to: %s", targetURL)
-	proxyReq, err := http.NewRequest(r.Method, targetURL, bytes.NewReader(modifiedBody))
-	if err != nil {
-		log.Printf("Error creating proxy request: %v", err)
-		http.Error(w, "Error creating proxy request", http.StatusInternalServerError)
+	// Apply the client's rate limits
+	limiter := limiters.get(client.name, client.limits)
+	adm, rlErr := limiter.admit(estimatePromptTokens(&chatReq), chatReq.Stream)
+	limiter.setHeaders(w.Header())
+	if rlErr != nil {
+		log.Printf("Rate limit exceeded for client %s: %s", client.name, rlErr.message)
+		writeRateLimitError(w, rlErr)
 		return
 	}
+	defer adm.release()
 
-	// Copy headers
-	copyHeaders(proxyReq.Header, r.Header)
-
-	// Set DeepSeek API key and content type
-	proxyReq.Header.Set("Authorization", "Bearer "+deepseekAPIKey)
-	proxyReq.Header.Set("Content-Type", "application/json")
-	if chatReq.Stream {
-		proxyReq.Header.Set("Accept", "text/event-stream")
+	// The upstream request is cancelled as soon as the client goes away or
+	// a timeout passes. A resumable stream outlives its client.
+	timeouts := st.config.Timeouts
+	resumable := chatReq.Stream && st.config.Resume.Enabled
+	base := r.Context()
+	if resumable {
+		base = context.Background()
+	}
+	ctx, cancel := context.WithCancel(base)
+	defer cancel()
+	watchdog := newStreamWatchdog(cancel)
+	defer watchdog.stop()
+
+	st.planStreams(targets, chatReq.Stream)
+	upstreamReq := &chatReq
+	var checks []answerCheck
+	if forced := parseForcedToolChoice(&chatReq); forced != nil {
+		// Targets that do not support the forced choice get it emulated
+		emulated := false
+		for i := range targets {
+			if !targets[i].backend.NativeToolChoice() {
+				targets[i].forced = forced
+				emulated = true
+			}
+		}
+		if emulated {
+			checks = append(checks, forced)
+		}
+	}
+	if jsonFormat != nil {
+		checks = append(checks, jsonFormat)
+	}
+	if len(checks) > 0 {
+		// Checked answers are complete before the client sees them, so the
+		// upstream does not stream
+		for i := range targets {
+			targets[i].stream = false
+		}
 	}
 
-	// Add Accept-Language header from request
-	if acceptLanguage := r.Header.Get("Accept-Language"); acceptLanguage != "" {
-		proxyReq.Header.Set("Accept-Language", acceptLanguage)
+	// Every attempt along the route has its own timeout, so a target that
+	// hangs leaves time to fall back. A stream must send its headers within
+	// the first byte timeout. A non-streaming upstream sends nothing until
+	// the whole answer is generated, so the request timeout bounds it as a
+	// whole. Streams are bounded as a whole by the stream timeout, or the
+	// request timeout for a client that does not stream.
+	anyStreams := false
+	for i, t := range targets {
+		anyStreams = anyStreams || t.stream
+		targets[i].timeout = timeouts.Request
+		if t.stream {
+			targets[i].timeout = timeouts.FirstByte
+		}
+	}
+	var overall time.Duration
+	if anyStreams {
+		overall = timeouts.Request
+		if chatReq.Stream {
+			overall = timeouts.Stream
+		}
+	}
+	if overall > 0 {
+		var cancelOverall context.CancelFunc
+		ctx, cancelOverall = context.WithTimeout(ctx, overall)
+		defer cancelOverall()
 	}
 
-	log.Printf("Proxy request headers: %v", proxyReq.Header)
+	// Send the request, falling back along the route on upstream failures
+	target, resp, err := sendWithFallback(ctx, r, upstreamReq, targets)
+	var discarded discardedUsage
+	if err == nil && len(checks) > 0 && resp.StatusCode < 400 {
+		target, resp, discarded, err = enforceAnswer(ctx, r, upstreamReq, checks, target, resp, originalModel)
+	}
 
-	// Create a custom client with keepalive
-	client := &http.Client{
-		Transport: &http2.Transport{
-			AllowHTTP: true,
-			DialTLS:   nil,
-		},
-		Timeout: 5 * time.Minute,
+	// finish records the usage, including that of answers discarded by the
+	// checks, and reports the cost, as a header or trailer
+	finish := func(result completionResult) {
+		result.discarded, result.discardedEstimated = discarded.usage, discarded.estimated
+		rec := recordUsage(st, rec, &chatReq, result, start)
+		adm.settle(rec.usage())
+		if rec.Cost != nil {
+			w.Header().Set(costHeader, formatCost(*rec.Cost))
+		}
 	}
 
-	// Send the request
-	resp, err := client.Do(proxyReq)
+	if err != nil && discarded.usage != nil {
+		// The upstream answered, but nothing is served
+		rec.Backend = target.backend.Name()
+		rec.UpstreamModel = target.model
+		rec.Status = http.StatusBadGateway
+		finish(completionResult{})
+	}
+	var rejected *errAnswerRejected
+	if errors.As(err, &rejected) {
+		log.Printf("Rejecting %s answer: %v", target.backend.Name(), rejected.err)
+		writeOpenAIError(w, http.StatusBadGateway, "server_error", "invalid_response_format", rejected.Error())
+		return
+	}
+	var imageErr *errImageDownload
+	if errors.As(err, &imageErr) {
+		log.Printf("No target can take the request's images: %v", imageErr)
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "invalid_image_url", imageErr.Error())
+		return
+	}
 	if err != nil {
 		log.Printf("Error forwarding request: %v", err)
 		http.Error(w, "Error forwarding request", http.StatusBadGateway)
@@ -426,8 +339,12 @@ func proxyHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer resp.Body.Close()
 
-	log.Printf("DeepSeek response status: %d", resp.StatusCode)
-	log.Printf("DeepSeek response headers: %v", resp.Header)
+	backend := target.backend
+	log.Printf("Model converted to: %s via %s (original: %s)", target.model, backend.Name(), originalModel)
+
+	rec.UpstreamModel = target.model
+	rec.Backend = backend.Name()
+	rec.Status = resp.StatusCode
 
 	// Handle error responses
 	if resp.StatusCode >= 400 {
@@ -437,275 +354,184 @@ func proxyHandler(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "Error reading response", http.StatusInternalServerError)
 			return
 		}
-		log.Printf("DeepSeek error response: %s", string(respBody))
+		log.Printf("%s error response: %s", backend.Name(), string(respBody))
 
 		// Forward the error response
 		for k, v := range resp.Header {
 			w.Header()[k] = v
 		}
+		finish(completionResult{})
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(resp.StatusCode)
 		w.Write(respBody)
 		return
 	}
 
-	// Handle streaming response
 	if chatReq.Stream {
-		handleStreamingResponse(w, r, resp, originalModel)
-		return
-	}
-
-	// Handle regular response
-	handleRegularResponse(w, resp, originalModel)
-}
-
-func handleStreamingResponse(w http.ResponseWriter, r *http.Request, resp *http.Response, originalModel string) {
-	log.Printf("Starting streaming response handling with model: %s", originalModel)
-	log.Printf("Response status: %d", resp.StatusCode)
-	log.Printf("Response headers: %+v", resp.Header)
-
-	// Set headers for streaming response
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
-	w.WriteHeader(resp.StatusCode)
-
-	// Create a buffered reader for the response body
-	reader := bufio.NewReader(resp.Body)
-
-	// Create a context with cancel for cleanup
-	ctx, cancel := context.WithCancel(r.Context())
-	defer cancel()
-
-	// Start a goroutine to send heartbeats
-	go func() {
-		ticker := time.NewTicker(15 * time.Second)
-		defer ticker.Stop()
-		for {
-			select {
-			case <-ticker.C:
-				// Send a heartbeat comment
-				if _, err := w.Write([]byte(": heartbeat\n\n")); err != nil {
-					log.Printf("Error sending heartbeat: %v", err)
-					cancel()
-					return
-				}
-				if f, ok := w.(http.Flusher); ok {
-					f.Flush()
-				}
-			case <-ctx.Done():
-				return
-			}
+		// Handle streaming response
+		declareCostTrailer(w)
+		// Resumable streams are buffered, and the client follows the buffer
+		var out http.ResponseWriter = w
+		var live *liveStream
+		followed := make(chan error, 1)
+		clientGone := func() bool { return r.Context().Err() != nil }
+		if resumable {
+			live = liveStreams.start(client.name, st.config.Resume.Window, cancel)
+			out = live
+			// The stream outlives its client; it is only abandoned when
+			// nobody follows it
+			clientGone = func() bool { return !live.followed() }
+			live.attach()
+			go func() {
+				defer live.detach()
+				followed <- live.follow(r.Context(), w, 0)
+			}()
 		}
-	}()
-
-	for {
-		select {
-		case <-ctx.Done():
-			log.Printf("Context cancelled, ending stream")
-			return
-		default:
-			line, err := reader.ReadBytes('\n')
-			if err != nil {
-				if err == io.EOF {
-					continue
-				}
-				log.Printf("Error reading stream: %v", err)
-				cancel()
-				return
-			}
-
-			// Skip empty lines
-			if len(bytes.TrimSpace(line)) == 0 {
-				continue
-			}
 
-			// Write the line to the response
-			if _, err := w.Write(line); err != nil {
-				log.Printf("Error writing to response: %v", err)
-				cancel()
-				return
+		tap := newStreamTap(out)
+		tap.record = cacheKey != ""
+		var upstream streamSource
+		if target.stream {
+			upstream = backend.TranslateStream(resp, target.translation, originalModel)
+		} else {
+			upstream = newCompletionSource(target, resp, originalModel)
+		}
+		src := newUsageSource(upstream, &chatReq, originalModel)
+		// Events of a non-streaming answer all come at once. A stream had its
+		// headers within the first byte timeout and gets as long again for
+		// its first event.
+		idle := timeouts.Idle
+		if target.stream {
+			watchdog.reset(timeouts.FirstByte, "first byte")
+		} else {
+			idle = 0
+		}
+		err := pumpStream(ctx, clientGone, tap, src, originalModel, watchdog, idle)
+		if live != nil {
+			live.close()
+			if followErr := <-followed; followErr != nil && err == nil {
+				log.Printf("Client left stream %s, it stays resumable for %s", live.id, st.config.Resume.Window)
 			}
-
-			// Flush the response writer
-			if f, ok := w.(http.Flusher); ok {
-				f.Flush()
-			} else {
-				log.Printf("Warning: ResponseWriter does not support Flush")
+		}
+		logStreamEnd(backend.Name(), err)
+		// The tap also saw estimated usage chunks; only upstream usage counts
+		transcript := tap.transcript()
+		transcript.Usage = src.reported
+		result := transcript.result()
+		finish(result)
+
+		if data, err := json.Marshal(transcript); err == nil {
+			log.Printf("Streamed response: %s", string(data))
+		}
+		st.saveTranscript(rec, transcript)
+
+		// Only complete streams are worth replaying
+		if cacheKey != "" && err == nil && result.finishReason != "" {
+			responses.put(&cacheEntry{
+				key:          cacheKey,
+				chunks:       tap.chunks,
+				backend:      backend.Name(),
+				model:        target.model,
+				finishReason: result.finishReason,
+			})
+		}
+	} else {
+		// Handle regular response
+		body, result := handleRegularResponse(w, target, resp, originalModel, finish)
+		if body != nil {
+			var completion chatCompletion
+			if err := json.Unmarshal(body, &completion); err == nil {
+				st.saveTranscript(rec, &completion)
 			}
 		}
+		if cacheKey != "" && body != nil && resp.StatusCode == http.StatusOK {
+			responses.put(&cacheEntry{
+				key:          cacheKey,
+				body:         body,
+				backend:      backend.Name(),
+				model:        target.model,
+				finishReason: result.finishReason,
+			})
+		}
 	}
 }
 
-func handleRegularResponse(w http.ResponseWriter, resp *http.Response, originalModel string) {
+// handleRegularResponse writes the translated response and returns it. A
+// streamed upstream answer is aggregated into one completion first. finish is
+// called with what it reported about usage and the finish reason before the
+// response headers are written.
+func handleRegularResponse(w http.ResponseWriter, target upstreamTarget, resp *http.Response, originalModel string, finish func(completionResult)) ([]byte, completionResult) {
 	log.Printf("Handling regular (non-streaming) response")
-	log.Printf("Response status: %d", resp.StatusCode)
-	log.Printf("Response headers: %+v", resp.Header)
-
-	// Read and log response body
-	body, err := readResponse(resp)
-	if err != nil {
-		log.Printf("Error reading response: %v", err)
-		http.Error(w, "Error reading response from upstream", http.StatusInternalServerError)
-		return
-	}
 
-	log.Printf("Original response body: %s", string(body))
-
-	// Parse the DeepSeek response
-	var deepseekResp struct {
-		ID      string `json:"id"`
-		Object  string `json:"object"`
-		Created int64  `json:"created"`
-		Model   string `json:"model"`
-		Choices []struct {
-			Index        int     `json:"index"`
-			Message      Message `json:"message"`
-			FinishReason string  `json:"finish_reason"`
-		} `json:"choices"`
-		Usage struct {
-			PromptTokens     int `json:"prompt_tokens"`
-			CompletionTokens int `json:"completion_tokens"`
-			TotalTokens      int `json:"total_tokens"`
-		} `json:"usage"`
-	}
-
-	if err := json.Unmarshal(body, &deepseekResp); err != nil {
-		log.Printf("Error parsing DeepSeek response: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-
-	// Convert to OpenAI format
-	openAIResp := struct {
-		ID      string `json:"id"`
-		Object  string `json:"object"`
-		Created int64  `json:"created"`
-		Model   string `json:"model"`
-		Choices []struct {
-			Index        int     `json:"index"`
-			Message      Message `json:"message"`
-			FinishReason string  `json:"finish_reason"`
-		} `json:"choices"`
-		Usage struct {
-			PromptTokens     int `json:"prompt_tokens"`
-			CompletionTokens int `json:"completion_tokens"`
-			TotalTokens      int `json:"total_tokens"`
-		} `json:"usage"`
-	}{
-		ID:      deepseekResp.ID,
-		Object:  "chat.completion",
-		Created: deepseekResp.Created,
-		Model:   originalModel,
-		Usage:   deepseekResp.Usage,
-	}
-
-	// Convert choices and ensure tool calls are properly handled
-	openAIResp.Choices = make([]struct {
-		Index        int     `json:"index"`
-		Message      Message `json:"message"`
-		FinishReason string  `json:"finish_reason"`
-	}, len(deepseekResp.Choices))
-
-	for i, choice := range deepseekResp.Choices {
-		openAIResp.Choices[i] = struct {
-			Index        int     `json:"index"`
-			Message      Message `json:"message"`
-			FinishReason string  `json:"finish_reason"`
-		}{
-			Index:        choice.Index,
-			Message:      choice.Message,
-			FinishReason: choice.FinishReason,
+	backend := target.backend
+	var modifiedBody []byte
+	if target.stream {
+		var err error
+		modifiedBody, err = aggregateStream(backend.TranslateStream(resp, target.translation, originalModel))
+		if err != nil {
+			log.Printf("Error aggregating %s stream: %v", backend.Name(), err)
+			finish(completionResult{})
+			http.Error(w, "Error reading response from upstream", http.StatusBadGateway)
+			return nil, completionResult{}
 		}
-
-		// Ensure tool calls are properly formatted in the message
-		if len(choice.Message.ToolCalls) > 0 {
-			log.Printf("Processing %d tool calls in choice %d", len(choice.Message.ToolCalls), i)
-			for j, tc := range choice.Message.ToolCalls {
-				log.Printf("Tool call %d: %+v", j, tc)
-				// Ensure the tool call has the required fields
-				if tc.Function.Name == "" {
-					log.Printf("Warning: Empty function name in tool call %d", j)
-					continue
-				}
-				// Keep the tool call as is since it's already in the correct format
-				openAIResp.Choices[i].Message.ToolCalls = append(openAIResp.Choices[i].Message.ToolCalls, tc)
-			}
+	} else {
+		// Read and log response body
+		body, err := readResponse(resp)
+		if err != nil {
+			log.Printf("Error reading response: %v", err)
+			finish(completionResult{})
+			http.Error(w, "Error reading response from upstream", http.StatusInternalServerError)
+			return nil, completionResult{}
 		}
-	}
 
-	// Convert back to JSON
-	modifiedBody, err := json.Marshal(openAIResp)
-	if err != nil {
-		log.Printf("Error creating modified response: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+		log.Printf("Original response body: %s", string(body))
+
+		modifiedBody, err = backend.TranslateResponse(body, target.translation, originalModel)
+		if err != nil {
+			log.Printf("Error translating %s response: %v", backend.Name(), err)
+			finish(completionResult{})
+			w.WriteHeader(http.StatusInternalServerError)
+			return nil, completionResult{}
+		}
 	}
 
 	log.Printf("Modified response body: %s", string(modifiedBody))
 
+	result := parseCompletionResult(modifiedBody)
+	finish(result)
+
 	// Set response headers
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(resp.StatusCode)
 	w.Write(modifiedBody)
 	log.Printf("Modified response sent successfully")
-}
-
-func copyHeaders(dst, src http.Header) {
-	// Headers to skip
-	skipHeaders := map[string]bool{
-		"Content-Length":    true,
-		"Content-Encoding":  true,
-		"Transfer-Encoding": true,
-		"Connection":        true,
-	}
 
-	for k, vv := range src {
-		if !skipHeaders[k] {
-			for _, v := range vv {
-				dst.Add(k, v)
-			}
-		}
-	}
+	return modifiedBody, result
 }
 
-func handleModelsRequest(w http.ResponseWriter) {
+func handleModelsRequest(w http.ResponseWriter, router *modelRouter) {
 	log.Printf("Handling models request")
-	
-	// Get the requested model from the query parameters
+
 	response := ModelsResponse{
 		Object: "list",
-		Data: []Model{
-			{
-				ID:      deepseekChatModel,
-				Object:  "model",
-				Created: time.Now().Unix(),
-				OwnedBy: "deepseek",
-			},
-		},
+		Data:   router.Models(),
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
-	log.Printf("Models response sent successfully")
-}
-
-func readResponse(resp *http.Response) ([]byte, error) {
-	var reader io.Reader = resp.Body
-
-	switch resp.Header.Get("Content-Encoding") {
-	case "gzip":
-		gzReader, err := gzip.NewReader(resp.Body)
-		if err != nil {
-			return nil, fmt.Errorf("error creating gzip reader: %v", err)
+	// Add the backends' own models unless a route already uses the same ID
+	seen := map[string]bool{}
+	for _, m := range response.Data {
+		seen[m.ID] = true
+	}
+	for _, name := range router.backendNames() {
+		for _, m := range router.backends[name].Models() {
+			if !seen[m.ID] {
+				seen[m.ID] = true
+				response.Data = append(response.Data, m)
+			}
 		}
-		defer gzReader.Close()
-		reader = gzReader
-	case "br":
-		reader = brotli.NewReader(resp.Body)
-	case "deflate":
-		reader = flate.NewReader(resp.Body)
 	}
 
-	return io.ReadAll(reader)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+	log.Printf("Models response sent successfully")
 }
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RateLimitConfig limits one client key. Zero values mean unlimited.
+type RateLimitConfig struct {
+	RequestsPerMinute    int `yaml:"requests_per_minute"`
+	TokensPerMinute      int `yaml:"tokens_per_minute"`
+	MaxConcurrentStreams int `yaml:"max_concurrent_streams"`
+}
+
+func (c RateLimitConfig) validate() error {
+	if c.RequestsPerMinute < 0 || c.TokensPerMinute < 0 || c.MaxConcurrentStreams < 0 {
+		return errors.New("rate limits must not be negative")
+	}
+	return nil
+}
+
+// tokenBucket refills continuously up to its per-minute capacity. The level
+// may go negative when actual usage turns out higher than estimated.
+type tokenBucket struct {
+	capacity float64
+	level    float64
+	updated  time.Time
+}
+
+func (b *tokenBucket) setCapacity(perMinute int, now time.Time) {
+	// Start full, also when a previously unlimited bucket gets a limit
+	if b.updated.IsZero() || b.capacity == 0 {
+		b.level = float64(perMinute)
+		b.updated = now
+	}
+	b.capacity = float64(perMinute)
+	b.refill(now)
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	elapsed := now.Sub(b.updated).Seconds()
+	b.updated = now
+	b.level = math.Min(b.capacity, b.level+elapsed*b.capacity/60)
+}
+
+// wait returns how long until n units are available.
+func (b *tokenBucket) wait(n float64) time.Duration {
+	if b.level >= n || b.capacity == 0 {
+		return 0
+	}
+	return time.Duration((n - b.level) / (b.capacity / 60) * float64(time.Second))
+}
+
+// resetIn returns how long until the bucket is full again.
+func (b *tokenBucket) resetIn() time.Duration {
+	return b.wait(b.capacity)
+}
+
+func (b *tokenBucket) remaining() int {
+	return int(math.Max(0, math.Floor(b.level)))
+}
+
+// clientLimiter holds the rate limit state of one client key. It outlives
+// config reloads so changing a limit does not reset the buckets.
+type clientLimiter struct {
+	mu       sync.Mutex
+	limits   RateLimitConfig
+	requests tokenBucket
+	tokens   tokenBucket
+	streams  int
+}
+
+type rateLimiters struct {
+	mu      sync.Mutex
+	clients map[string]*clientLimiter
+}
+
+var limiters = &rateLimiters{clients: map[string]*clientLimiter{}}
+
+// get returns the limiter for the named client with the given limits applied.
+func (rl *rateLimiters) get(name string, limits RateLimitConfig) *clientLimiter {
+	rl.mu.Lock()
+	cl, ok := rl.clients[name]
+	if !ok {
+		cl = &clientLimiter{}
+		rl.clients[name] = cl
+	}
+	rl.mu.Unlock()
+
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	if !ok || cl.limits != limits {
+		now := time.Now()
+		cl.limits = limits
+		cl.requests.setCapacity(limits.RequestsPerMinute, now)
+		cl.tokens.setCapacity(limits.TokensPerMinute, now)
+	}
+	return cl
+}
+
+// rateLimitError describes why a request was rejected.
+type rateLimitError struct {
+	limit      string // "requests", "tokens" or "streams"
+	message    string
+	retryAfter time.Duration
+}
+
+// admission is a request that passed the rate limiter. Release must be called
+// when the request finishes.
+type admission struct {
+	limiter   *clientLimiter
+	estimated int
+	stream    bool
+	once      sync.Once
+}
+
+// admit charges one request and the estimated tokens against the client's
+// buckets and reserves a stream slot for streaming requests.
+func (cl *clientLimiter) admit(estimatedTokens int, stream bool) (*admission, *rateLimitError) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	now := time.Now()
+	cl.requests.refill(now)
+	cl.tokens.refill(now)
+
+	if cl.limits.RequestsPerMinute > 0 {
+		if wait := cl.requests.wait(1); wait > 0 {
+			return nil, &rateLimitError{
+				limit:      "requests",
+				message:    fmt.Sprintf("Rate limit reached for requests: limit %d per minute. Please try again in %s.", cl.limits.RequestsPerMinute, formatResetDuration(wait)),
+				retryAfter: wait,
+			}
+		}
+	}
+
+	if cl.limits.TokensPerMinute > 0 {
+		// A single request larger than the whole budget only needs a full bucket
+		need := math.Min(float64(estimatedTokens), cl.tokens.capacity)
+		if wait := cl.tokens.wait(need); wait > 0 {
+			return nil, &rateLimitError{
+				limit:      "tokens",
+				message:    fmt.Sprintf("Rate limit reached for tokens: limit %d per minute, requested %d. Please try again in %s.", cl.limits.TokensPerMinute, estimatedTokens, formatResetDuration(wait)),
+				retryAfter: wait,
+			}
+		}
+	}
+
+	if stream && cl.limits.MaxConcurrentStreams > 0 && cl.streams >= cl.limits.MaxConcurrentStreams {
+		return nil, &rateLimitError{
+			limit:      "streams",
+			message:    fmt.Sprintf("Too many concurrent streams: limit %d. Please wait for a running completion to finish.", cl.limits.MaxConcurrentStreams),
+			retryAfter: time.Second,
+		}
+	}
+
+	if cl.limits.RequestsPerMinute > 0 {
+		cl.requests.level--
+	}
+	if cl.limits.TokensPerMinute > 0 {
+		cl.tokens.level -= float64(estimatedTokens)
+	}
+	if stream {
+		cl.streams++
+	}
+
+	return &admission{limiter: cl, estimated: estimatedTokens, stream: stream}, nil
+}
+
+// settle corrects the token bucket once the actual usage is known.
+func (a *admission) settle(usage *Usage) {
+	if usage == nil {
+		return
+	}
+	cl := a.limiter
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	if cl.limits.TokensPerMinute > 0 {
+		cl.tokens.level += float64(a.estimated - usage.TotalTokens)
+	}
+	a.estimated = usage.TotalTokens
+}
+
+// release frees the stream slot held by the request.
+func (a *admission) release() {
+	a.once.Do(func() {
+		if !a.stream {
+			return
+		}
+		cl := a.limiter
+		cl.mu.Lock()
+		cl.streams--
+		cl.mu.Unlock()
+	})
+}
+
+// setHeaders adds the x-ratelimit-* headers OpenAI clients use to pace
+// themselves.
+func (cl *clientLimiter) setHeaders(h http.Header) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	now := time.Now()
+	if cl.limits.RequestsPerMinute > 0 {
+		cl.requests.refill(now)
+		h.Set("x-ratelimit-limit-requests", strconv.Itoa(cl.limits.RequestsPerMinute))
+		h.Set("x-ratelimit-remaining-requests", strconv.Itoa(cl.requests.remaining()))
+		h.Set("x-ratelimit-reset-requests", formatResetDuration(cl.requests.resetIn()))
+	}
+	if cl.limits.TokensPerMinute > 0 {
+		cl.tokens.refill(now)
+		h.Set("x-ratelimit-limit-tokens", strconv.Itoa(cl.limits.TokensPerMinute))
+		h.Set("x-ratelimit-remaining-tokens", strconv.Itoa(cl.tokens.remaining()))
+		h.Set("x-ratelimit-reset-tokens", formatResetDuration(cl.tokens.resetIn()))
+	}
+}
+
+// writeRateLimitError answers with an OpenAI-style 429.
+func writeRateLimitError(w http.ResponseWriter, rlErr *rateLimitError) {
+	seconds := int(math.Ceil(rlErr.retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	writeOpenAIError(w, http.StatusTooManyRequests, rlErr.limit, "rate_limit_exceeded", rlErr.message)
+}
+
+// formatResetDuration formats durations the way OpenAI's reset headers do,
+// e.g. "1s", "6m0s" or "120ms".
+func formatResetDuration(d time.Duration) string {
+	if d < time.Second {
+		return fmt.Sprintf("%dms", d.Milliseconds())
+	}
+	return d.Round(time.Second).String()
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucketRefill(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	var b tokenBucket
+	b.setCapacity(60, now)
+	if b.level != 60 {
+		t.Fatalf("new bucket level = %v, want full at 60", b.level)
+	}
+
+	b.level = 0
+	b.refill(now.Add(10 * time.Second))
+	if b.level != 10 {
+		t.Errorf("level after 10s = %v, want 10", b.level)
+	}
+	if got := b.wait(15); got != 5*time.Second {
+		t.Errorf("wait(15) = %v, want 5s", got)
+	}
+	if got := b.resetIn(); got != 50*time.Second {
+		t.Errorf("resetIn = %v, want 50s", got)
+	}
+
+	b.refill(now.Add(5 * time.Minute))
+	if b.level != 60 {
+		t.Errorf("level after 5m = %v, want capped at 60", b.level)
+	}
+
+	// A negative level after an underestimate takes longer to recover
+	b.level = -30
+	if got := b.wait(1); got != 31*time.Second {
+		t.Errorf("wait(1) from -30 = %v, want 31s", got)
+	}
+	if b.remaining() != 0 {
+		t.Errorf("remaining = %d, want 0", b.remaining())
+	}
+}
+
+func TestTokenBucketSetCapacity(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	var b tokenBucket
+	b.setCapacity(0, now)
+	if got := b.wait(1000); got != 0 {
+		t.Errorf("unlimited bucket waits %v", got)
+	}
+
+	// Getting a limit starts full, changing it keeps the level
+	b.setCapacity(100, now)
+	if b.level != 100 {
+		t.Errorf("level after getting a limit = %v, want 100", b.level)
+	}
+	b.level = 20
+	b.setCapacity(200, now)
+	if b.level != 20 {
+		t.Errorf("level after changing the limit = %v, want 20", b.level)
+	}
+}
+
+func TestAdmitAndSettle(t *testing.T) {
+	cl := (&rateLimiters{clients: map[string]*clientLimiter{}}).get("alice", RateLimitConfig{
+		RequestsPerMinute:    2,
+		TokensPerMinute:      1000,
+		MaxConcurrentStreams: 1,
+	})
+
+	adm, rlErr := cl.admit(400, true)
+	if rlErr != nil {
+		t.Fatalf("first request rejected: %s", rlErr.message)
+	}
+	if _, rlErr := cl.admit(10, true); rlErr == nil || rlErr.limit != "streams" {
+		t.Errorf("second stream: %v, want the streams limit", rlErr)
+	}
+	adm.release()
+	adm.release()
+	if cl.streams != 0 {
+		t.Errorf("streams after release = %d, want 0", cl.streams)
+	}
+
+	// The actual usage replaces the estimate, once
+	adm.settle(&Usage{TotalTokens: 900})
+	if level := cl.tokens.remaining(); level < 99 || level > 101 {
+		t.Errorf("tokens after settling 900 = %d, want about 100", level)
+	}
+	adm.settle(&Usage{TotalTokens: 900})
+	if level := cl.tokens.remaining(); level < 99 || level > 101 {
+		t.Errorf("tokens after settling again = %d, want still about 100", level)
+	}
+	adm.settle(nil)
+
+	if _, rlErr := cl.admit(500, false); rlErr == nil || rlErr.limit != "tokens" {
+		t.Errorf("request over the token budget: %v, want the tokens limit", rlErr)
+	}
+	if _, rlErr := cl.admit(10, false); rlErr != nil {
+		t.Fatalf("second request rejected: %s", rlErr.message)
+	}
+	if _, rlErr := cl.admit(10, false); rlErr == nil || rlErr.limit != "requests" {
+		t.Errorf("third request: %v, want the requests limit", rlErr)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// What to do with the reasoning of reasoning models such as deepseek-reasoner
+const (
+	reasoningDrop        = "drop"        // remove it
+	reasoningThink       = "think"       // prepend it to the content as a <think> block
+	reasoningPassthrough = "passthrough" // keep it in the reasoning_content field
+)
+
+const (
+	thinkOpenTag  = "<think>"
+	thinkCloseTag = "</think>"
+)
+
+func validateReasoningPolicy(policy string) error {
+	switch policy {
+	case "", reasoningDrop, reasoningThink, reasoningPassthrough:
+		return nil
+	}
+	return fmt.Errorf("invalid reasoning policy %q, expected drop, think or passthrough", policy)
+}
+
+// reasoningPolicy returns the configured policy, passthrough by default.
+func (bc BackendConfig) reasoningPolicy() string {
+	if bc.Reasoning == "" {
+		return reasoningPassthrough
+	}
+	return bc.Reasoning
+}
+
+// applyReasoningPolicy rewrites the reasoning of a complete message.
+func applyReasoningPolicy(msg *Message, policy string) {
+	if msg.ReasoningContent == "" {
+		return
+	}
+	switch policy {
+	case reasoningDrop:
+		msg.ReasoningContent = ""
+	case reasoningThink:
+		msg.Content = thinkOpenTag + "\n" + msg.ReasoningContent + "\n" + thinkCloseTag + "\n\n" + msg.Content
+		msg.ReasoningContent = ""
+	}
+}
+
+// stripReasoning removes the reasoning of earlier assistant turns, both the
+// reasoning_content field and <think> blocks the proxy put into the content.
+// DeepSeek rejects reasoning_content in input messages.
+func stripReasoning(messages []Message) {
+	for i := range messages {
+		if messages[i].Role != "assistant" {
+			continue
+		}
+		messages[i].ReasoningContent = ""
+		messages[i].Content = stripThinkBlocks(messages[i].Content)
+	}
+}
+
+// stripThinkBlocks removes leading <think>...</think> blocks from content.
+func stripThinkBlocks(content string) string {
+	trimmed := strings.TrimLeft(content, " \t\r\n")
+	for strings.HasPrefix(trimmed, thinkOpenTag) {
+		end := strings.Index(trimmed, thinkCloseTag)
+		if end < 0 {
+			return content
+		}
+		trimmed = strings.TrimLeft(trimmed[end+len(thinkCloseTag):], " \t\r\n")
+		content = trimmed
+	}
+	return content
+}
+
+// reasoningTransform applies policy to the reasoning_content deltas of a
+// stream. In think mode it opens a <think> block with the first reasoning
+// delta and closes it before the first content delta.
+func reasoningTransform(policy string) chunkTransform {
+	thinking := map[interface{}]bool{} // per choice index
+
+	return func(chunk map[string]interface{}) bool {
+		if policy == reasoningPassthrough {
+			return true
+		}
+
+		choices, _ := chunk["choices"].([]interface{})
+		keep := len(choices) == 0 || chunk["usage"] != nil
+		for _, c := range choices {
+			choice, _ := c.(map[string]interface{})
+			delta, _ := choice["delta"].(map[string]interface{})
+			if delta == nil {
+				keep = true
+				continue
+			}
+			index := choice["index"]
+
+			reasoning, _ := delta["reasoning_content"].(string)
+			delete(delta, "reasoning_content")
+			content, _ := delta["content"].(string)
+
+			if policy == reasoningThink {
+				switch {
+				case reasoning != "":
+					if !thinking[index] {
+						thinking[index] = true
+						reasoning = thinkOpenTag + "\n" + reasoning
+					}
+					content = reasoning + content
+				case thinking[index] && (content != "" || choice["finish_reason"] != nil || delta["tool_calls"] != nil):
+					thinking[index] = false
+					content = "\n" + thinkCloseTag + "\n\n" + content
+				}
+				if content != "" {
+					delta["content"] = content
+				}
+			}
+
+			// Drop deltas that only carried reasoning
+			if content != "" || delta["role"] != nil || delta["tool_calls"] != nil || choice["finish_reason"] != nil {
+				keep = true
+			}
+		}
+		return keep
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	lastEventIDHeader = "Last-Event-ID"
+
+	defaultResumeWindow = 2 * time.Minute
+)
+
+// ResumeConfig lets clients reconnect to a stream that broke off
+type ResumeConfig struct {
+	Enabled bool `yaml:"enabled"`
+
+	// Window is how long a finished stream stays resumable and how long a
+	// stream keeps generating with no client attached
+	Window time.Duration `yaml:"window"`
+}
+
+// liveStream buffers the events of one in-progress stream so that clients
+// can follow it and resume it after a dropped connection. It is the
+// http.ResponseWriter of pumpStream, which writes every event in a single
+// Write; events with data are numbered, the rest are not kept.
+type liveStream struct {
+	id     string
+	client string
+	window time.Duration
+	cancel context.CancelFunc // cancels the upstream request
+	header http.Header
+
+	mu        sync.Mutex
+	events    [][]byte
+	changed   chan struct{} // closed whenever events are added or the stream ends
+	closed    bool
+	followers int
+	orphaned  *time.Timer // cancels the upstream when nobody follows
+}
+
+func (ls *liveStream) Header() http.Header { return ls.header }
+
+func (ls *liveStream) WriteHeader(int) {}
+
+func (ls *liveStream) Flush() {}
+
+func (ls *liveStream) Write(p []byte) (int, error) {
+	if !bytes.HasPrefix(p, []byte("data:")) && !bytes.Contains(p, []byte("\ndata:")) {
+		// Heartbeats are sent by each follower itself
+		return len(p), nil
+	}
+
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	id := fmt.Sprintf("id: %s-%d\n", ls.id, len(ls.events)+1)
+	ls.events = append(ls.events, append([]byte(id), p...))
+	ls.notify()
+	return len(p), nil
+}
+
+// notify wakes the followers. The caller holds mu.
+func (ls *liveStream) notify() {
+	close(ls.changed)
+	ls.changed = make(chan struct{})
+}
+
+// close marks the end of the stream; it stays resumable for the window.
+func (ls *liveStream) close() {
+	ls.mu.Lock()
+	ls.closed = true
+	if ls.orphaned != nil {
+		ls.orphaned.Stop()
+	}
+	ls.notify()
+	ls.mu.Unlock()
+
+	time.AfterFunc(ls.window, func() { liveStreams.remove(ls.id) })
+}
+
+// follow writes the events after the first n to w until the stream ends or
+// the client goes away. The caller attaches the client first and detaches it
+// afterwards.
+func (ls *liveStream) follow(ctx context.Context, w http.ResponseWriter, n int) error {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+
+	heartbeat := time.NewTicker(streamHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		ls.mu.Lock()
+		var events [][]byte
+		if n < len(ls.events) {
+			events = ls.events[n:]
+		}
+		closed, changed := ls.closed, ls.changed
+		ls.mu.Unlock()
+
+		for _, ev := range events {
+			if _, err := w.Write(ev); err != nil {
+				return errClientGone
+			}
+			n++
+		}
+		if flusher != nil && len(events) > 0 {
+			flusher.Flush()
+		}
+		if closed {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-heartbeat.C:
+			if _, err := w.Write([]byte(": heartbeat\n\n")); err != nil {
+				return errClientGone
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		case <-ctx.Done():
+			return errClientGone
+		}
+	}
+}
+
+// followed reports whether a client is following the stream.
+func (ls *liveStream) followed() bool {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	return ls.followers > 0
+}
+
+func (ls *liveStream) attach() {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	ls.followers++
+	if ls.orphaned != nil {
+		ls.orphaned.Stop()
+		ls.orphaned = nil
+	}
+}
+
+// detach removes a follower. A stream nobody follows keeps generating for
+// the window, then its upstream request is cancelled.
+func (ls *liveStream) detach() {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	ls.followers--
+	if ls.followers > 0 || ls.closed {
+		return
+	}
+	ls.orphaned = time.AfterFunc(ls.window, func() {
+		log.Printf("No client resumed stream %s within %s, cancelling upstream", ls.id, ls.window)
+		ls.cancel()
+	})
+}
+
+// liveStreamRegistry holds the resumable streams by id.
+type liveStreamRegistry struct {
+	mu      sync.Mutex
+	streams map[string]*liveStream
+}
+
+var liveStreams = &liveStreamRegistry{streams: map[string]*liveStream{}}
+
+func (reg *liveStreamRegistry) start(client string, window time.Duration, cancel context.CancelFunc) *liveStream {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	ls := &liveStream{
+		id:      hex.EncodeToString(buf),
+		client:  client,
+		window:  window,
+		cancel:  cancel,
+		header:  http.Header{},
+		changed: make(chan struct{}),
+	}
+
+	reg.mu.Lock()
+	reg.streams[ls.id] = ls
+	reg.mu.Unlock()
+	return ls
+}
+
+func (reg *liveStreamRegistry) remove(id string) {
+	reg.mu.Lock()
+	delete(reg.streams, id)
+	reg.mu.Unlock()
+}
+
+// lookup resolves a Last-Event-ID to its stream and the number of events the
+// client already received.
+func (reg *liveStreamRegistry) lookup(lastEventID string) (*liveStream, int, bool) {
+	i := strings.LastIndexByte(lastEventID, '-')
+	if i < 0 {
+		return nil, 0, false
+	}
+	n, err := strconv.Atoi(lastEventID[i+1:])
+	if err != nil || n < 0 {
+		return nil, 0, false
+	}
+
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	ls, ok := reg.streams[lastEventID[:i]]
+	return ls, n, ok
+}
+
+// resumeStream serves a reconnecting client the rest of the stream it was
+// following.
+func resumeStream(w http.ResponseWriter, r *http.Request, client *clientIdentity, lastEventID string) {
+	ls, n, ok := liveStreams.lookup(lastEventID)
+	if !ok || ls.client != client.name {
+		log.Printf("Cannot resume stream %s for client %s", lastEventID, client.name)
+		writeOpenAIError(w, http.StatusNotFound, "invalid_request_error", "stream_not_found",
+			"The stream cannot be resumed: it is unknown or has expired. Send the request again without Last-Event-ID.")
+		return
+	}
+
+	log.Printf("Resuming stream %s for client %s after event %d", ls.id, client.name, n)
+	ls.attach()
+	defer ls.detach()
+	if err := ls.follow(r.Context(), w, n); err != nil {
+		log.Printf("Resumed stream %s ended early: %v", ls.id, err)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLiveStreamLookup(t *testing.T) {
+	ls := liveStreams.start("alice", time.Minute, func() {})
+	defer liveStreams.remove(ls.id)
+
+	tests := []struct {
+		lastEventID string
+		n           int
+		ok          bool
+	}{
+		{ls.id + "-0", 0, true},
+		{ls.id + "-3", 3, true},
+		{ls.id + "-12", 12, true},
+		{ls.id, 0, false},
+		{ls.id + "-", 0, false},
+		{ls.id + "-x", 0, false},
+		{ls.id + "--1", 0, false},
+		{"unknown-1", 0, false},
+		{"", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.lastEventID, func(t *testing.T) {
+			got, n, ok := liveStreams.lookup(tt.lastEventID)
+			if ok != tt.ok || (ok && (got != ls || n != tt.n)) {
+				t.Errorf("lookup = %v, %d, %v, want %d, %v", got != nil, n, ok, tt.n, tt.ok)
+			}
+		})
+	}
+}
+
+func TestLiveStreamFollow(t *testing.T) {
+	ls := liveStreams.start("alice", time.Minute, func() {})
+	defer liveStreams.remove(ls.id)
+	for _, data := range []string{"one", "two", "three"} {
+		ls.Write([]byte("data: " + data + "\n\n"))
+	}
+	ls.Write([]byte(": heartbeat\n\n"))
+	ls.close()
+
+	tests := []struct {
+		n    int
+		want string
+	}{
+		{0, "id: ID-1\ndata: one\n\nid: ID-2\ndata: two\n\nid: ID-3\ndata: three\n\n"},
+		{2, "id: ID-3\ndata: three\n\n"},
+		{3, ""},
+		{7, ""},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		if err := ls.follow(context.Background(), rec, tt.n); err != nil {
+			t.Fatal(err)
+		}
+		want := strings.ReplaceAll(tt.want, "ID", ls.id)
+		if got := rec.Body.String(); got != want {
+			t.Errorf("follow from %d = %q, want %q", tt.n, got, want)
+		}
+	}
+}
+
+// A follower sees events written after it attached and returns when the
+// stream ends.
+func TestLiveStreamFollowLive(t *testing.T) {
+	ls := liveStreams.start("alice", time.Minute, func() {})
+	defer liveStreams.remove(ls.id)
+	ls.Write([]byte("data: one\n\n"))
+
+	rec := httptest.NewRecorder()
+	done := make(chan error)
+	ls.attach()
+	go func() {
+		defer ls.detach()
+		done <- ls.follow(context.Background(), rec, 1)
+	}()
+	ls.Write([]byte("data: two\n\n"))
+	ls.close()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("follow did not return after the stream ended")
+	}
+	if want := "id: " + ls.id + "-2\ndata: two\n\n"; rec.Body.String() != want {
+		t.Errorf("got %q, want %q", rec.Body.String(), want)
+	}
+}
+
+func TestResumeStreamOtherClient(t *testing.T) {
+	ls := liveStreams.start("alice", time.Minute, func() {})
+	defer liveStreams.remove(ls.id)
+	ls.Write([]byte("data: one\n\n"))
+	ls.close()
+
+	tests := []struct {
+		client      string
+		lastEventID string
+		status      int
+	}{
+		{"alice", ls.id + "-0", http.StatusOK},
+		{"bob", ls.id + "-0", http.StatusNotFound},
+		{"alice", "unknown-0", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+		resumeStream(rec, r, &clientIdentity{name: tt.client}, tt.lastEventID)
+		if rec.Code != tt.status {
+			t.Errorf("%s resuming %s: status %d, want %d", tt.client, tt.lastEventID, rec.Code, tt.status)
+		}
+		if tt.status == http.StatusNotFound && strings.Contains(rec.Body.String(), "data: one") {
+			t.Errorf("%s resuming %s got the stream's events", tt.client, tt.lastEventID)
+		}
+	}
+}
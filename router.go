@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// routeTarget names a backend and the upstream model to request from it.
+// An empty model means the backend's default model.
+type routeTarget struct {
+	backend string
+	model   string
+}
+
+func (t routeTarget) String() string {
+	if t.model == "" {
+		return t.backend
+	}
+	return t.backend + ":" + t.model
+}
+
+// modelRoute maps a client model ID to a chain of targets that are tried in
+// order. A pattern ending in "*" is a prefix rule and the pattern "*" alone is
+// the default route.
+type modelRoute struct {
+	pattern string
+	targets []routeTarget
+}
+
+func (r modelRoute) targetsString() string {
+	names := make([]string, len(r.targets))
+	for i, t := range r.targets {
+		names[i] = t.String()
+	}
+	return strings.Join(names, " -> ")
+}
+
+func (r modelRoute) isPrefix() bool {
+	return strings.HasSuffix(r.pattern, "*")
+}
+
+// upstreamTarget is a resolved routeTarget.
+type upstreamTarget struct {
+	backend Backend
+	model   string
+	stream  bool // the upstream request streams
+
+	// A forced tool choice the backend does not support, emulated
+	forced *forcedToolChoice
+
+	// timeout bounds one attempt at the target: until the response headers
+	// for streams, the whole request otherwise
+	timeout time.Duration
+
+	// How the request was translated, set once it is sent
+	translation translation
+}
+
+// modelRouter resolves the model a client asked for to a backend and
+// upstream model, plus any fallbacks.
+type modelRouter struct {
+	backends       map[string]Backend
+	defaultBackend Backend
+	exact          map[string]modelRoute
+	prefixes       []modelRoute // longest prefix first
+	fallback       *modelRoute
+}
+
+// parseRouteTarget parses "backend" or "backend:model".
+func parseRouteTarget(spec string) (routeTarget, error) {
+	spec = strings.TrimSpace(spec)
+	name, model, _ := strings.Cut(spec, ":")
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return routeTarget{}, fmt.Errorf("missing backend in %q", spec)
+	}
+	return routeTarget{backend: name, model: strings.TrimSpace(model)}, nil
+}
+
+// newModelRouter builds a router over backends from routes, checking that
+// every target refers to a configured backend.
+func newModelRouter(backends map[string]Backend, defaultName string, routes []modelRoute) (*modelRouter, error) {
+	rt := &modelRouter{
+		backends:       backends,
+		defaultBackend: backends[defaultName],
+		exact:          map[string]modelRoute{},
+	}
+	for _, route := range routes {
+		for _, target := range route.targets {
+			if _, ok := backends[target.backend]; !ok {
+				return nil, fmt.Errorf("route %s refers to unknown backend %q", route.pattern, target.backend)
+			}
+		}
+
+		switch {
+		case route.pattern == "*":
+			route := route
+			rt.fallback = &route
+		case route.isPrefix():
+			rt.prefixes = append(rt.prefixes, route)
+		default:
+			rt.exact[route.pattern] = route
+		}
+	}
+
+	sort.SliceStable(rt.prefixes, func(i, j int) bool {
+		return len(rt.prefixes[i].pattern) > len(rt.prefixes[j].pattern)
+	})
+
+	return rt, nil
+}
+
+// match returns the route for clientModel, or nil when only the default
+// backend applies.
+func (rt *modelRouter) match(clientModel string) *modelRoute {
+	if route, ok := rt.exact[clientModel]; ok {
+		return &route
+	}
+	for i, route := range rt.prefixes {
+		if strings.HasPrefix(clientModel, strings.TrimSuffix(route.pattern, "*")) {
+			return &rt.prefixes[i]
+		}
+	}
+	return rt.fallback
+}
+
+// native returns the backend that serves clientModel under its own name,
+// preferring the default backend.
+func (rt *modelRouter) native(clientModel string) (routeTarget, bool) {
+	if clientModel == "" {
+		return routeTarget{}, false
+	}
+	names := append([]string{rt.defaultBackend.Name()}, rt.backendNames()...)
+	for _, name := range names {
+		for _, m := range rt.backends[name].Models() {
+			if m.ID == clientModel {
+				return routeTarget{backend: name, model: clientModel}, true
+			}
+		}
+	}
+	return routeTarget{}, false
+}
+
+// Resolve returns the targets to try for clientModel, primary first. Models
+// without an exact or prefix route that a backend offers itself, such as
+// deepseek-reasoner, go to that backend. Other requests take the "*" route or
+// go to the default backend and its default model.
+func (rt *modelRouter) Resolve(clientModel string) []upstreamTarget {
+	targets := []routeTarget{{backend: rt.defaultBackend.Name()}}
+	route := rt.match(clientModel)
+	if route == rt.fallback {
+		if target, ok := rt.native(clientModel); ok {
+			route = nil
+			targets = []routeTarget{target}
+			log.Printf("Model %q is served by %s", clientModel, target.backend)
+		}
+	}
+	if route != nil {
+		targets = route.targets
+		log.Printf("Model %q matched route %q -> %s", clientModel, route.pattern, route.targetsString())
+	}
+
+	resolved := make([]upstreamTarget, len(targets))
+	for i, target := range targets {
+		resolved[i] = rt.resolve(target)
+	}
+	return resolved
+}
+
+// resolve looks up the backend of target and fills in its default model.
+func (rt *modelRouter) resolve(target routeTarget) upstreamTarget {
+	backend := rt.backends[target.backend]
+	model := target.model
+	if model == "" {
+		model = backend.DefaultModel()
+	}
+	return upstreamTarget{backend: backend, model: model}
+}
+
+// Models lists the client model IDs that have an exact route.
+func (rt *modelRouter) Models() []Model {
+	names := make([]string, 0, len(rt.exact))
+	for name := range rt.exact {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	models := make([]Model, 0, len(names))
+	for _, name := range names {
+		models = append(models, Model{
+			ID:      name,
+			Object:  "model",
+			Created: time.Now().Unix(),
+			OwnedBy: rt.exact[name].targets[0].backend,
+		})
+	}
+	return models
+}
+
+// backendNames returns the configured backend names in a stable order.
+func (rt *modelRouter) backendNames() []string {
+	names := make([]string, 0, len(rt.backends))
+	for name := range rt.backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxSchemaDepth bounds nested $ref resolution, which may be recursive
+const maxSchemaDepth = 64
+
+// maxSchemaSteps bounds the work of one validation. Combinators over
+// recursive $refs otherwise take exponential time in the depth.
+const maxSchemaSteps = 100000
+
+// jsonSchema validates JSON values against a JSON Schema. It covers the
+// keywords that structured output schemas use; annotations and keywords it
+// does not know, like format, are ignored.
+type jsonSchema struct {
+	root  interface{}
+	steps int // left for the running validation
+}
+
+var errSchemaTooComplex = fmt.Errorf("the schema needs more than %d steps to validate the answer", maxSchemaSteps)
+
+// compileSchema parses a schema, which is an object or a boolean.
+func compileSchema(raw json.RawMessage) (*jsonSchema, error) {
+	var root interface{}
+	if err := json.Unmarshal(raw, &root); err != nil {
+		return nil, fmt.Errorf("invalid JSON schema: %v", err)
+	}
+	switch root.(type) {
+	case map[string]interface{}, bool:
+	default:
+		return nil, fmt.Errorf("invalid JSON schema: it must be an object or a boolean")
+	}
+	return &jsonSchema{root: root}, nil
+}
+
+// validate returns the first violation of the schema by the decoded value.
+func (s *jsonSchema) validate(v interface{}) error {
+	s.steps = maxSchemaSteps
+	return s.validateAt(s.root, v, "$", 0)
+}
+
+// outOfSteps reports whether the validation used up its steps. Combinators
+// that ignore the errors of their subschemas check it to stop early.
+func (s *jsonSchema) outOfSteps() bool {
+	return s.steps < 0
+}
+
+func (s *jsonSchema) validateAt(schema interface{}, v interface{}, path string, depth int) error {
+	if s.steps--; s.outOfSteps() {
+		return errSchemaTooComplex
+	}
+	if depth > maxSchemaDepth {
+		return fmt.Errorf("%s: schema references nest too deeply", path)
+	}
+	switch schema := schema.(type) {
+	case bool:
+		if !schema {
+			return fmt.Errorf("%s: no value is allowed here", path)
+		}
+		return nil
+	case map[string]interface{}:
+		return s.validateObject(schema, v, path, depth)
+	}
+	return nil
+}
+
+func (s *jsonSchema) validateObject(schema map[string]interface{}, v interface{}, path string, depth int) error {
+	if ref, ok := schema["$ref"].(string); ok {
+		target, err := s.resolve(ref)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		if err := s.validateAt(target, v, path, depth+1); err != nil {
+			return err
+		}
+	}
+
+	if t, ok := schema["type"]; ok && !matchesType(t, v) {
+		return fmt.Errorf("%s: expected %s, got %s", path, typeNames(t), jsonType(v))
+	}
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, e := range enum {
+			if reflect.DeepEqual(e, v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: %s is not one of the allowed values", path, valueText(v))
+		}
+	}
+	if c, ok := schema["const"]; ok && !reflect.DeepEqual(c, v) {
+		return fmt.Errorf("%s: expected %s, got %s", path, valueText(c), valueText(v))
+	}
+
+	var err error
+	switch v := v.(type) {
+	case string:
+		err = validateString(schema, v, path)
+	case float64:
+		err = validateNumber(schema, v, path)
+	case []interface{}:
+		err = s.validateArray(schema, v, path, depth)
+	case map[string]interface{}:
+		err = s.validateProperties(schema, v, path, depth)
+	}
+	if err != nil {
+		return err
+	}
+
+	return s.validateCombinators(schema, v, path, depth)
+}
+
+func (s *jsonSchema) validateCombinators(schema map[string]interface{}, v interface{}, path string, depth int) error {
+	if all, ok := schema["allOf"].([]interface{}); ok {
+		for _, sub := range all {
+			if err := s.validateAt(sub, v, path, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+	if anyOf, ok := schema["anyOf"].([]interface{}); ok && len(anyOf) > 0 {
+		var first error
+		for i, sub := range anyOf {
+			err := s.validateAt(sub, v, path, depth+1)
+			if s.outOfSteps() {
+				return errSchemaTooComplex
+			}
+			if err == nil {
+				first = nil
+				break
+			}
+			if i == 0 {
+				first = err
+			}
+		}
+		if first != nil {
+			return fmt.Errorf("%s: matches none of the anyOf schemas (first: %v)", path, first)
+		}
+	}
+	if one, ok := schema["oneOf"].([]interface{}); ok {
+		matched := 0
+		for _, sub := range one {
+			if s.validateAt(sub, v, path, depth+1) == nil {
+				matched++
+			}
+			if s.outOfSteps() {
+				return errSchemaTooComplex
+			}
+		}
+		if matched != 1 {
+			return fmt.Errorf("%s: matches %d of the oneOf schemas, expected exactly 1", path, matched)
+		}
+	}
+	if not, ok := schema["not"]; ok {
+		err := s.validateAt(not, v, path, depth+1)
+		if s.outOfSteps() {
+			return errSchemaTooComplex
+		}
+		if err == nil {
+			return fmt.Errorf("%s: matches a schema it must not match", path)
+		}
+	}
+	return nil
+}
+
+func validateString(schema map[string]interface{}, v string, path string) error {
+	n := utf8.RuneCountInString(v)
+	if min, ok := schemaNumber(schema, "minLength"); ok && float64(n) < min {
+		return fmt.Errorf("%s: string is shorter than %v characters", path, min)
+	}
+	if max, ok := schemaNumber(schema, "maxLength"); ok && float64(n) > max {
+		return fmt.Errorf("%s: string is longer than %v characters", path, max)
+	}
+	if pattern, ok := schema["pattern"].(string); ok {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			// Patterns outside RE2 cannot be checked here
+			return nil
+		}
+		if !re.MatchString(v) {
+			return fmt.Errorf("%s: string does not match pattern %q", path, pattern)
+		}
+	}
+	return nil
+}
+
+func validateNumber(schema map[string]interface{}, v float64, path string) error {
+	// Draft 4 spells exclusive bounds as booleans next to minimum and maximum
+	exclusiveMin, _ := schema["exclusiveMinimum"].(bool)
+	exclusiveMax, _ := schema["exclusiveMaximum"].(bool)
+
+	if min, ok := schemaNumber(schema, "minimum"); ok {
+		if v < min || (exclusiveMin && v == min) {
+			return fmt.Errorf("%s: %v is less than the minimum %v", path, v, min)
+		}
+	}
+	if max, ok := schemaNumber(schema, "maximum"); ok {
+		if v > max || (exclusiveMax && v == max) {
+			return fmt.Errorf("%s: %v is greater than the maximum %v", path, v, max)
+		}
+	}
+	if min, ok := schemaNumber(schema, "exclusiveMinimum"); ok && v <= min {
+		return fmt.Errorf("%s: %v is not greater than %v", path, v, min)
+	}
+	if max, ok := schemaNumber(schema, "exclusiveMaximum"); ok && v >= max {
+		return fmt.Errorf("%s: %v is not less than %v", path, v, max)
+	}
+	if m, ok := schemaNumber(schema, "multipleOf"); ok && m > 0 {
+		if q := v / m; math.Abs(q-math.Round(q)) > 1e-9 {
+			return fmt.Errorf("%s: %v is not a multiple of %v", path, v, m)
+		}
+	}
+	return nil
+}
+
+func (s *jsonSchema) validateArray(schema map[string]interface{}, v []interface{}, path string, depth int) error {
+	if min, ok := schemaNumber(schema, "minItems"); ok && float64(len(v)) < min {
+		return fmt.Errorf("%s: array has fewer than %v items", path, min)
+	}
+	if max, ok := schemaNumber(schema, "maxItems"); ok && float64(len(v)) > max {
+		return fmt.Errorf("%s: array has more than %v items", path, max)
+	}
+	if unique, _ := schema["uniqueItems"].(bool); unique {
+		for i := range v {
+			for j := i + 1; j < len(v); j++ {
+				if reflect.DeepEqual(v[i], v[j]) {
+					return fmt.Errorf("%s: items %d and %d are equal", path, i, j)
+				}
+			}
+		}
+	}
+
+	// Tuples are prefixItems, or items as an array in older drafts
+	prefix, _ := schema["prefixItems"].([]interface{})
+	rest, hasRest := schema["items"]
+	if tuple, ok := rest.([]interface{}); ok {
+		prefix = tuple
+		rest, hasRest = schema["additionalItems"]
+	}
+	for i, item := range v {
+		itemPath := path + "[" + strconv.Itoa(i) + "]"
+		switch {
+		case i < len(prefix):
+			if err := s.validateAt(prefix[i], item, itemPath, depth+1); err != nil {
+				return err
+			}
+		case hasRest:
+			if err := s.validateAt(rest, item, itemPath, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *jsonSchema) validateProperties(schema map[string]interface{}, v map[string]interface{}, path string, depth int) error {
+	if required, ok := schema["required"].([]interface{}); ok {
+		for _, name := range required {
+			if name, ok := name.(string); ok {
+				if _, present := v[name]; !present {
+					return fmt.Errorf("%s: missing required property %q", path, name)
+				}
+			}
+		}
+	}
+	if min, ok := schemaNumber(schema, "minProperties"); ok && float64(len(v)) < min {
+		return fmt.Errorf("%s: object has fewer than %v properties", path, min)
+	}
+	if max, ok := schemaNumber(schema, "maxProperties"); ok && float64(len(v)) > max {
+		return fmt.Errorf("%s: object has more than %v properties", path, max)
+	}
+
+	properties, _ := schema["properties"].(map[string]interface{})
+	patterns, _ := schema["patternProperties"].(map[string]interface{})
+	additional, hasAdditional := schema["additionalProperties"]
+
+	// Sorted so that the first error reported is the same every time
+	names := make([]string, 0, len(v))
+	for name := range v {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		propPath := path + "." + name
+		matched := false
+		if sub, ok := properties[name]; ok {
+			matched = true
+			if err := s.validateAt(sub, v[name], propPath, depth+1); err != nil {
+				return err
+			}
+		}
+		for pattern, sub := range patterns {
+			if re, err := regexp.Compile(pattern); err == nil && re.MatchString(name) {
+				matched = true
+				if err := s.validateAt(sub, v[name], propPath, depth+1); err != nil {
+					return err
+				}
+			}
+		}
+		if matched || !hasAdditional {
+			continue
+		}
+		if allowed, ok := additional.(bool); ok && !allowed {
+			return fmt.Errorf("%s: property %q is not allowed", path, name)
+		}
+		if err := s.validateAt(additional, v[name], propPath, depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolve returns the schema a local $ref like #/$defs/item points to.
+func (s *jsonSchema) resolve(ref string) (interface{}, error) {
+	if ref == "#" {
+		return s.root, nil
+	}
+	if !strings.HasPrefix(ref, "#/") {
+		return nil, fmt.Errorf("unsupported schema reference %q, only local references are", ref)
+	}
+	node := s.root
+	for _, token := range strings.Split(ref[2:], "/") {
+		token = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+		switch n := node.(type) {
+		case map[string]interface{}:
+			node = n[token]
+		case []interface{}:
+			i, err := strconv.Atoi(token)
+			if err != nil || i < 0 || i >= len(n) {
+				return nil, fmt.Errorf("schema reference %q not found", ref)
+			}
+			node = n[i]
+		default:
+			node = nil
+		}
+		if node == nil {
+			return nil, fmt.Errorf("schema reference %q not found", ref)
+		}
+	}
+	return node, nil
+}
+
+func schemaNumber(schema map[string]interface{}, key string) (float64, bool) {
+	n, ok := schema[key].(float64)
+	return n, ok
+}
+
+// matchesType checks a value against the type keyword, a name or a list of
+// names.
+func matchesType(t interface{}, v interface{}) bool {
+	switch t := t.(type) {
+	case string:
+		return isType(t, v)
+	case []interface{}:
+		for _, name := range t {
+			if name, ok := name.(string); ok && isType(name, v) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func isType(name string, v interface{}) bool {
+	actual := jsonType(v)
+	switch name {
+	case "number":
+		return actual == "number" || actual == "integer"
+	case "integer":
+		return actual == "integer"
+	}
+	return actual == name
+}
+
+// jsonType names the type of a decoded value; whole numbers are integers.
+func jsonType(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if v == math.Trunc(v) && !math.IsInf(v, 0) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+func typeNames(t interface{}) string {
+	if list, ok := t.([]interface{}); ok {
+		names := make([]string, len(list))
+		for i, name := range list {
+			names[i] = fmt.Sprint(name)
+		}
+		return strings.Join(names, " or ")
+	}
+	return fmt.Sprint(t)
+}
+
+func valueText(v interface{}) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return truncateString(string(data), 50)
+}
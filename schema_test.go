@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJSONSchemaValidate(t *testing.T) {
+	const tree = `{
+		"$ref": "#/$defs/node",
+		"$defs": {
+			"node": {
+				"type": "object",
+				"properties": {
+					"name": {"type": "string"},
+					"children": {"type": "array", "items": {"$ref": "#/$defs/node"}}
+				},
+				"required": ["name"],
+				"additionalProperties": false
+			}
+		}
+	}`
+	const shape = `{
+		"anyOf": [
+			{"type": "string", "maxLength": 3},
+			{"type": "integer", "minimum": 0}
+		]
+	}`
+	const id = `{
+		"oneOf": [
+			{"type": "integer"},
+			{"type": "number", "minimum": 10}
+		]
+	}`
+	const settings = `{
+		"type": "object",
+		"properties": {"name": {"type": "string"}},
+		"patternProperties": {"^x-": {"type": "boolean"}},
+		"additionalProperties": {"type": "integer"}
+	}`
+
+	tests := []struct {
+		name    string
+		schema  string
+		value   string
+		wantErr string // substring of the error, empty when valid
+	}{
+		{"$ref valid", tree, `{"name": "a", "children": [{"name": "b", "children": []}]}`, ""},
+		{"$ref nested violation", tree, `{"name": "a", "children": [{"children": []}]}`, `$.children[0]: missing required property "name"`},
+		{"$ref additional property", tree, `{"name": "a", "extra": 1}`, `$: property "extra" is not allowed`},
+		{"$ref escaped pointer", `{"$ref": "#/$defs/a~1b", "$defs": {"a/b": {"type": "null"}}}`, `null`, ""},
+		{"$ref missing", `{"$ref": "#/$defs/none"}`, `1`, `schema reference "#/$defs/none" not found`},
+		{"$ref remote", `{"$ref": "https://example.com/schema.json"}`, `1`, "only local references"},
+		{"$ref recursion", `{"$ref": "#"}`, `1`, "nest too deeply"},
+
+		{"anyOf first", shape, `"abc"`, ""},
+		{"anyOf second", shape, `7`, ""},
+		{"anyOf none", shape, `"abcd"`, "matches none of the anyOf schemas"},
+		{"anyOf negative", shape, `-1`, "matches none of the anyOf schemas"},
+
+		{"oneOf exactly one", id, `3`, ""},
+		{"oneOf other one", id, `10.5`, ""},
+		{"oneOf both", id, `12`, "matches 2 of the oneOf schemas"},
+		{"oneOf neither", id, `2.5`, "matches 0 of the oneOf schemas"},
+
+		{"additionalProperties schema", settings, `{"name": "a", "x-debug": true, "retries": 3}`, ""},
+		{"additionalProperties violation", settings, `{"retries": "3"}`, "$.retries: expected integer, got string"},
+		{"patternProperties violation", settings, `{"x-debug": 1}`, "$.x-debug: expected boolean, got integer"},
+		{"additionalProperties absent", `{"properties": {"a": {"type": "string"}}}`, `{"a": "x", "b": 1}`, ""},
+
+		{"false schema", `false`, `1`, "no value is allowed here"},
+		{"type list", `{"type": ["string", "null"]}`, `null`, ""},
+		{"enum", `{"enum": ["a", 1]}`, `"b"`, "is not one of the allowed values"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := compileSchema(json.RawMessage(tt.schema))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var v interface{}
+			if err := json.Unmarshal([]byte(tt.value), &v); err != nil {
+				t.Fatal(err)
+			}
+			err = s.validate(v)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case tt.wantErr != "" && err == nil:
+				t.Errorf("valid, want an error containing %q", tt.wantErr)
+			case tt.wantErr != "" && !strings.Contains(err.Error(), tt.wantErr):
+				t.Errorf("error %q, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCompileSchemaRejectsNonSchemas(t *testing.T) {
+	for _, raw := range []string{`"string"`, `[]`, `{`} {
+		if _, err := compileSchema(json.RawMessage(raw)); err == nil {
+			t.Errorf("compileSchema(%s) succeeded", raw)
+		}
+	}
+}
+
+func TestExtractJSON(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{`{"a": 1}`, `{"a": 1}`},
+		{"```json\n{\"a\": 1}\n```", `{"a": 1}`},
+		{"Here you go:\n{\"a\": {\"b\": 2}}\nHope this helps.", `{"a": {"b": 2}}`},
+		{"The list: [1, 2] done", `[1, 2]`},
+	}
+	for _, tt := range tests {
+		got, _, err := extractJSON(tt.text)
+		if err != nil || got != tt.want {
+			t.Errorf("extractJSON(%q) = %q, %v, want %q", tt.text, got, err, tt.want)
+		}
+	}
+	if _, _, err := extractJSON("no JSON here"); err == nil {
+		t.Error("extractJSON of plain text succeeded")
+	}
+}
+
+func TestJSONSchemaStepBudget(t *testing.T) {
+	schemas := []string{
+		`{"anyOf": [{"$ref": "#"}, {"$ref": "#"}]}`,
+		`{"oneOf": [{"$ref": "#"}, {"$ref": "#"}, {"$ref": "#"}]}`,
+	}
+	for _, raw := range schemas {
+		s, err := compileSchema(json.RawMessage(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		start := time.Now()
+		err = s.validate(1.0)
+		if err != errSchemaTooComplex {
+			t.Errorf("%s: error %v, want %v", raw, err, errSchemaTooComplex)
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("%s: validation took %v", raw, elapsed)
+		}
+
+		// The budget is per validation
+		if err := s.validate(1.0); err != errSchemaTooComplex {
+			t.Errorf("%s: second validation: %v", raw, err)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+)
+
+// sseEvent is one server-sent event. Comment lines are kept so they can be
+// passed through.
+type sseEvent struct {
+	comments []string
+	event    string
+	id       string
+	retry    string
+	data     []byte // data lines joined with "\n"
+	hasData  bool
+}
+
+// isDone reports whether the event is the OpenAI stream terminator.
+func (ev *sseEvent) isDone() bool {
+	return ev.hasData && string(bytes.TrimSpace(ev.data)) == "[DONE]"
+}
+
+func (ev *sseEvent) empty() bool {
+	return len(ev.comments) == 0 && ev.event == "" && ev.id == "" && ev.retry == "" && !ev.hasData
+}
+
+// sseReader parses a text/event-stream body into events.
+type sseReader struct {
+	r *bufio.Reader
+}
+
+func newSSEReader(r io.Reader) *sseReader {
+	return &sseReader{r: bufio.NewReader(r)}
+}
+
+// next returns the next event. At the end of the stream an unterminated last
+// event is still returned; after that next returns io.EOF.
+func (s *sseReader) next() (*sseEvent, error) {
+	ev := &sseEvent{}
+	for {
+		line, err := s.r.ReadString('\n')
+		if err != nil && (err != io.EOF || line == "") {
+			if err == io.EOF && !ev.empty() {
+				return ev, nil
+			}
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		if line == "" {
+			if ev.empty() {
+				continue
+			}
+			return ev, nil
+		}
+		if strings.HasPrefix(line, ":") {
+			ev.comments = append(ev.comments, strings.TrimPrefix(line[1:], " "))
+			continue
+		}
+
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch field {
+		case "data":
+			if ev.hasData {
+				ev.data = append(ev.data, '\n')
+			}
+			ev.data = append(ev.data, value...)
+			ev.hasData = true
+		case "event":
+			ev.event = value
+		case "id":
+			ev.id = value
+		case "retry":
+			ev.retry = value
+		}
+	}
+}
+
+// writeSSEEvent serializes ev, ending it with a blank line.
+func writeSSEEvent(w io.Writer, ev *sseEvent) error {
+	var buf bytes.Buffer
+	for _, c := range ev.comments {
+		buf.WriteString(": " + c + "\n")
+	}
+	if ev.event != "" {
+		buf.WriteString("event: " + ev.event + "\n")
+	}
+	if ev.id != "" {
+		buf.WriteString("id: " + ev.id + "\n")
+	}
+	if ev.retry != "" {
+		buf.WriteString("retry: " + ev.retry + "\n")
+	}
+	if ev.hasData {
+		for _, line := range bytes.Split(ev.data, []byte("\n")) {
+			buf.WriteString("data: ")
+			buf.Write(line)
+			buf.WriteByte('\n')
+		}
+	}
+	buf.WriteByte('\n')
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// chunkTransform edits a decoded chat.completion.chunk in place. Returning
+// false drops the chunk.
+type chunkTransform func(chunk map[string]interface{}) bool
+
+// chunkRewriter makes the chunks of one stream consistent: every chunk
+// reports the model the client asked for and the id and system fingerprint
+// of the first chunk. Further transforms run after that.
+type chunkRewriter struct {
+	model       string
+	id          string
+	fingerprint string
+	transforms  []chunkTransform
+}
+
+func newChunkRewriter(model string, transforms ...chunkTransform) *chunkRewriter {
+	return &chunkRewriter{model: model, transforms: transforms}
+}
+
+// rewrite transforms the data of one event. Data that is not a JSON object
+// is passed through unchanged.
+func (cr *chunkRewriter) rewrite(data []byte) ([]byte, bool) {
+	var chunk map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&chunk); err != nil || chunk == nil {
+		return data, true
+	}
+
+	chunk["model"] = cr.model
+	if id, _ := chunk["id"].(string); id != "" {
+		if cr.id == "" {
+			cr.id = id
+		}
+		chunk["id"] = cr.id
+	}
+	if fp, _ := chunk["system_fingerprint"].(string); fp != "" {
+		if cr.fingerprint == "" {
+			cr.fingerprint = fp
+		}
+		chunk["system_fingerprint"] = cr.fingerprint
+	}
+
+	for _, transform := range cr.transforms {
+		if !transform(chunk) {
+			return nil, false
+		}
+	}
+
+	out, err := json.Marshal(chunk)
+	if err != nil {
+		return data, true
+	}
+	return out, true
+}
+
+// sseSource is the streamSource of upstreams that already speak OpenAI SSE.
+// Chunks go through the rewriter; comments and [DONE] pass through as they
+// are.
+type sseSource struct {
+	events   *sseReader
+	rewriter *chunkRewriter
+	done     bool
+}
+
+func newSSESource(body io.Reader, rewriter *chunkRewriter) *sseSource {
+	return &sseSource{events: newSSEReader(body), rewriter: rewriter}
+}
+
+func (s *sseSource) next() (*sseEvent, error) {
+	for {
+		ev, err := s.events.next()
+		if err == io.EOF && !s.done {
+			// OpenAI-style streams end with [DONE]
+			return nil, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		s.done = s.done || ev.isDone()
+		if ev.hasData && !ev.isDone() {
+			data, keep := s.rewriter.rewrite(ev.data)
+			if !keep {
+				continue
+			}
+			ev.data = data
+		}
+		return ev, nil
+	}
+}
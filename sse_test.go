@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestSSEReader(t *testing.T) {
+	stream := ": keep-alive\n\n" +
+		"event: message\r\nid: 1\r\ndata: {\"a\":1}\r\n\r\n" +
+		"data: line one\ndata: line two\n\n\n\n" +
+		"data: [DONE]\n\n"
+	r := newSSEReader(strings.NewReader(stream))
+
+	ev, err := r.next()
+	if err != nil || len(ev.comments) != 1 || ev.comments[0] != "keep-alive" || ev.hasData {
+		t.Fatalf("comment event = %+v, %v", ev, err)
+	}
+	ev, err = r.next()
+	if err != nil || ev.event != "message" || ev.id != "1" || string(ev.data) != `{"a":1}` {
+		t.Fatalf("CRLF event = %+v, %v", ev, err)
+	}
+	ev, err = r.next()
+	if err != nil || string(ev.data) != "line one\nline two" {
+		t.Fatalf("multi-line event = %+v, %v", ev, err)
+	}
+	ev, err = r.next()
+	if err != nil || !ev.isDone() {
+		t.Fatalf("[DONE] event = %+v, %v", ev, err)
+	}
+	if ev, err = r.next(); err != io.EOF {
+		t.Fatalf("after [DONE]: %+v, %v, want io.EOF", ev, err)
+	}
+}
+
+func TestSSEReaderUnterminatedEvent(t *testing.T) {
+	r := newSSEReader(strings.NewReader("data: {\"a\":1}\n\ndata: [DONE]"))
+	if _, err := r.next(); err != nil {
+		t.Fatal(err)
+	}
+	ev, err := r.next()
+	if err != nil || !ev.isDone() {
+		t.Fatalf("unterminated last event = %+v, %v, want [DONE]", ev, err)
+	}
+	if _, err := r.next(); err != io.EOF {
+		t.Fatalf("got %v, want io.EOF", err)
+	}
+}
+
+func TestSSESourceEnd(t *testing.T) {
+	tests := []struct {
+		name   string
+		stream string
+		want   error
+	}{
+		{"with [DONE]", "data: {\"id\":\"x\"}\n\ndata: [DONE]\n\n", io.EOF},
+		{"cut off", "data: {\"id\":\"x\"}\n\n", io.ErrUnexpectedEOF},
+		{"empty", "", io.ErrUnexpectedEOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := newSSESource(strings.NewReader(tt.stream), newChunkRewriter("gpt-4o"))
+			var err error
+			for err == nil {
+				_, err = src.next()
+			}
+			if err != tt.want {
+				t.Errorf("stream ended with %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestSSESourceRewritesChunks(t *testing.T) {
+	stream := "data: {\"id\":\"a\",\"model\":\"deepseek-chat\",\"system_fingerprint\":\"fp1\"}\n\n" +
+		"data: {\"id\":\"b\",\"model\":\"deepseek-chat\",\"system_fingerprint\":\"fp2\"}\n\n" +
+		"data: [DONE]\n\n"
+	src := newSSESource(strings.NewReader(stream), newChunkRewriter("gpt-4o"))
+
+	var out bytes.Buffer
+	for {
+		ev, err := src.next()
+		if err != nil {
+			break
+		}
+		writeSSEEvent(&out, ev)
+	}
+	want := "data: {\"id\":\"a\",\"model\":\"gpt-4o\",\"system_fingerprint\":\"fp1\"}\n\n" +
+		"data: {\"id\":\"a\",\"model\":\"gpt-4o\",\"system_fingerprint\":\"fp1\"}\n\n" +
+		"data: [DONE]\n\n"
+	if out.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", out.String(), want)
+	}
+}
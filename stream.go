@@ -0,0 +1,397 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	streamHeartbeatInterval = 15 * time.Second
+
+	defaultFirstByteTimeout = 2 * time.Minute
+	defaultIdleTimeout      = time.Minute
+	defaultStreamTimeout    = 30 * time.Minute
+)
+
+// streamSource yields the events of an upstream stream translated to OpenAI
+// chat.completion.chunk events. next returns io.EOF at the end of the stream.
+type streamSource interface {
+	next() (*sseEvent, error)
+}
+
+// streamWatchdog cancels the upstream request of a stream that stays silent
+// for too long: first until the first byte arrives, then between chunks.
+type streamWatchdog struct {
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	timer  *time.Timer
+	reason string // set once the watchdog fired
+}
+
+func newStreamWatchdog(cancel context.CancelFunc) *streamWatchdog {
+	return &streamWatchdog{cancel: cancel}
+}
+
+// reset restarts the watchdog with a new timeout. Zero disables it.
+func (wd *streamWatchdog) reset(timeout time.Duration, what string) {
+	wd.mu.Lock()
+	defer wd.mu.Unlock()
+	if wd.timer != nil {
+		wd.timer.Stop()
+		wd.timer = nil
+	}
+	if timeout <= 0 || wd.reason != "" {
+		return
+	}
+	wd.timer = time.AfterFunc(timeout, func() {
+		wd.mu.Lock()
+		wd.reason = fmt.Sprintf("no %s from upstream within %s", what, timeout)
+		wd.mu.Unlock()
+		wd.cancel()
+	})
+}
+
+func (wd *streamWatchdog) stop() {
+	wd.reset(0, "")
+}
+
+// expired returns why the watchdog cancelled the stream, if it did.
+func (wd *streamWatchdog) expired() string {
+	wd.mu.Lock()
+	defer wd.mu.Unlock()
+	return wd.reason
+}
+
+type streamResult struct {
+	ev  *sseEvent
+	err error
+}
+
+// streamState is what the pump saw of the chunks it forwarded, so that it
+// can end a broken stream consistently.
+type streamState struct {
+	id       string
+	created  int64
+	model    string
+	seen     bool // id and created come from the upstream
+	finished bool // a finish_reason was sent
+}
+
+func (ss *streamState) observe(ev *sseEvent) {
+	if !ev.hasData || ev.isDone() {
+		return
+	}
+	var chunk struct {
+		ID      string `json:"id"`
+		Created int64  `json:"created"`
+		Model   string `json:"model"`
+		Choices []struct {
+			FinishReason *string `json:"finish_reason"`
+		} `json:"choices"`
+	}
+	if err := json.Unmarshal(ev.data, &chunk); err != nil {
+		return
+	}
+	if !ss.seen && chunk.ID != "" {
+		ss.seen = true
+		ss.id, ss.created = chunk.ID, chunk.Created
+	}
+	for _, choice := range chunk.Choices {
+		if choice.FinishReason != nil && *choice.FinishReason != "" {
+			ss.finished = true
+		}
+	}
+}
+
+// failureEvents ends a stream that broke off: a final chunk with a
+// finish_reason unless one was sent, an OpenAI-style error event and [DONE],
+// so clients can show the error instead of waiting for the rest.
+func (ss *streamState) failureEvents(cause error) []*sseEvent {
+	var events []*sseEvent
+	if !ss.finished {
+		final, _ := json.Marshal(map[string]interface{}{
+			"id":      ss.id,
+			"object":  "chat.completion.chunk",
+			"created": ss.created,
+			"model":   ss.model,
+			"choices": []map[string]interface{}{
+				{
+					"index":         0,
+					"delta":         map[string]interface{}{},
+					"finish_reason": "stop",
+				},
+			},
+		})
+		events = append(events, &sseEvent{data: final, hasData: true})
+	}
+
+	code := "upstream_error"
+	if errors.Is(cause, errStreamTimeout) {
+		code = "upstream_timeout"
+	}
+	errData, _ := json.Marshal(OpenAIError{
+		Error: OpenAIErrorDetail{
+			Message: fmt.Sprintf("The upstream stream failed: %v", cause),
+			Type:    "server_error",
+			Code:    code,
+		},
+	})
+	events = append(events, &sseEvent{data: errData, hasData: true})
+	return append(events, &sseEvent{data: []byte("[DONE]"), hasData: true})
+}
+
+// pumpStream sends the events of src to the client. It is the stream loop of
+// every backend: it keeps the connection alive with heartbeats while the
+// upstream is quiet, resets the idle timeout on every upstream event and ends
+// the stream with [DONE]. ctx is the context of the upstream request, so
+// returning early because the client left or a deadline passed cancels the
+// upstream call. clientGone reports whether nobody reads the stream anymore,
+// in which case a failure is not written out.
+func pumpStream(ctx context.Context, clientGone func() bool, w http.ResponseWriter, src streamSource, model string, wd *streamWatchdog, idle time.Duration) error {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	flusher, _ := w.(http.Flusher)
+	send := func(ev *sseEvent) error {
+		if err := writeSSEEvent(w, ev); err != nil {
+			return fmt.Errorf("error writing to client: %v", err)
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	}
+
+	// Read upstream in the background so timeouts and heartbeats can
+	// interrupt a blocked read
+	done := make(chan struct{})
+	defer close(done)
+	results := make(chan streamResult)
+	go func() {
+		for {
+			ev, err := src.next()
+			select {
+			case results <- streamResult{ev, err}:
+			case <-done:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	heartbeat := time.NewTicker(streamHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	state := streamState{
+		id:      "chatcmpl-" + time.Now().Format("20060102150405"),
+		created: time.Now().Unix(),
+		model:   model,
+	}
+	fail := func(err error) error {
+		err = streamError(clientGone(), wd, err)
+		if errors.Is(err, errClientGone) {
+			return err
+		}
+		for _, ev := range state.failureEvents(err) {
+			if sendErr := send(ev); sendErr != nil {
+				break
+			}
+		}
+		return err
+	}
+
+	for {
+		select {
+		case res := <-results:
+			wd.reset(idle, "data")
+			if res.err == io.EOF {
+				// Ollama never sends [DONE]
+				return send(&sseEvent{data: []byte("[DONE]"), hasData: true})
+			}
+			if res.err != nil {
+				return fail(res.err)
+			}
+			state.observe(res.ev)
+			if err := send(res.ev); err != nil {
+				return err
+			}
+			if res.ev.isDone() {
+				return nil
+			}
+
+		case <-heartbeat.C:
+			if err := send(&sseEvent{comments: []string{"heartbeat"}}); err != nil {
+				return err
+			}
+
+		case <-ctx.Done():
+			return fail(ctx.Err())
+		}
+	}
+}
+
+var (
+	errClientGone    = errors.New("client disconnected")
+	errStreamTimeout = errors.New("stream timed out")
+)
+
+// streamError explains why a stream ended early.
+func streamError(clientGone bool, wd *streamWatchdog, err error) error {
+	switch {
+	case clientGone:
+		return errClientGone
+	case wd.expired() != "":
+		return fmt.Errorf("%w: %s", errStreamTimeout, wd.expired())
+	case errors.Is(err, context.DeadlineExceeded):
+		return fmt.Errorf("%w: the stream exceeded its total timeout", errStreamTimeout)
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return errors.New("upstream closed the stream before it was complete")
+	}
+	return fmt.Errorf("error reading stream: %v", err)
+}
+
+// logStreamEnd logs how a stream finished.
+func logStreamEnd(backend string, err error) {
+	if err != nil {
+		log.Printf("Stream from %s ended early: %v", backend, err)
+		return
+	}
+	log.Printf("Stream from %s completed", backend)
+}
+
+// newUsageChunk builds the final chunk of a stream that reports usage: no
+// choices, only the usage block.
+func newUsageChunk(id string, created int64, model string, usage *Usage) *sseEvent {
+	data, _ := json.Marshal(map[string]interface{}{
+		"id":      id,
+		"object":  "chat.completion.chunk",
+		"created": created,
+		"model":   model,
+		"choices": []interface{}{},
+		"usage":   usage,
+	})
+	return &sseEvent{data: data, hasData: true}
+}
+
+// usageSource applies the client's stream_options to a stream. Backends
+// always report usage when they can; the usage chunk is passed on only when
+// the client set include_usage, and estimated locally when the upstream did
+// not send one.
+type usageSource struct {
+	src     streamSource
+	include bool
+	prompt  int // estimated prompt tokens
+
+	id       string
+	created  int64
+	model    string
+	text     strings.Builder // everything generated, for the estimate
+	reported *Usage          // usage sent by the upstream
+	ended    bool            // the estimate was sent, return io.EOF next
+	pending  *sseEvent       // [DONE] held back behind the estimate
+}
+
+func newUsageSource(src streamSource, chatReq *ChatRequest, model string) *usageSource {
+	return &usageSource{
+		src:     src,
+		include: chatReq.includeUsage(),
+		prompt:  estimatePromptTokens(chatReq),
+		id:      "chatcmpl-" + time.Now().Format("20060102150405"),
+		created: time.Now().Unix(),
+		model:   model,
+	}
+}
+
+func (s *usageSource) next() (*sseEvent, error) {
+	if s.pending != nil {
+		ev := s.pending
+		s.pending = nil
+		return ev, nil
+	}
+	if s.ended {
+		return nil, io.EOF
+	}
+
+	for {
+		ev, err := s.src.next()
+		if err == io.EOF && s.needsEstimate() {
+			s.ended = true
+			return s.estimate(), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if ev.isDone() {
+			if s.needsEstimate() {
+				s.pending = ev
+				return s.estimate(), nil
+			}
+			return ev, nil
+		}
+		if ev.hasData && !s.observe(ev.data) {
+			continue
+		}
+		return ev, nil
+	}
+}
+
+// observe notes the content and usage of a chunk. It returns false for a
+// usage chunk the client did not ask for.
+func (s *usageSource) observe(data []byte) bool {
+	var chunk struct {
+		ID      string `json:"id"`
+		Created int64  `json:"created"`
+		Choices []struct {
+			Delta struct {
+				Content          string     `json:"content"`
+				ReasoningContent string     `json:"reasoning_content"`
+				ToolCalls        []ToolCall `json:"tool_calls"`
+			} `json:"delta"`
+		} `json:"choices"`
+		Usage *Usage `json:"usage"`
+	}
+	if err := json.Unmarshal(data, &chunk); err != nil {
+		return true
+	}
+	if chunk.ID != "" {
+		s.id, s.created = chunk.ID, chunk.Created
+	}
+	for _, choice := range chunk.Choices {
+		s.text.WriteString(choice.Delta.ReasoningContent)
+		s.text.WriteString(choice.Delta.Content)
+		for _, tc := range choice.Delta.ToolCalls {
+			s.text.WriteString(tc.Function.Name)
+			s.text.WriteString(tc.Function.Arguments)
+		}
+	}
+	if chunk.Usage == nil {
+		return true
+	}
+	s.reported = chunk.Usage
+	return s.include || len(chunk.Choices) > 0
+}
+
+func (s *usageSource) needsEstimate() bool {
+	return s.include && s.reported == nil
+}
+
+func (s *usageSource) estimate() *sseEvent {
+	completion := estimateTokens(s.text.String())
+	return newUsageChunk(s.id, s.created, s.model, &Usage{
+		PromptTokens:     s.prompt,
+		CompletionTokens: completion,
+		TotalTokens:      s.prompt + completion,
+	})
+}
@@ -0,0 +1,85 @@
+package main
+
+import "strings"
+
+// thinkParser separates the inline <think>...</think> blocks of R1-style
+// models from the answer. Tags may be split across stream chunks, so text
+// that could be the start of a tag is held back until the next chunk.
+type thinkParser struct {
+	inThink    bool
+	afterThink bool // trim the whitespace that follows a closing tag
+	pending    string
+}
+
+// feed returns the answer and reasoning text contained in the next piece of
+// the stream.
+func (p *thinkParser) feed(text string) (content, reasoning string) {
+	buf := p.pending + text
+	p.pending = ""
+
+	var out, thought strings.Builder
+	for buf != "" {
+		tag := thinkOpenTag
+		if p.inThink {
+			tag = thinkCloseTag
+		}
+
+		piece := buf
+		idx := strings.Index(buf, tag)
+		if idx >= 0 {
+			piece = buf[:idx]
+			buf = buf[idx+len(tag):]
+		} else {
+			// Hold back a possible partial tag at the end
+			keep := partialSuffix(buf, tag)
+			piece = buf[:len(buf)-keep]
+			p.pending = buf[len(buf)-keep:]
+			buf = ""
+		}
+
+		if p.inThink {
+			thought.WriteString(piece)
+		} else {
+			if p.afterThink {
+				piece = strings.TrimLeft(piece, " \t\r\n")
+				p.afterThink = piece == ""
+			}
+			out.WriteString(piece)
+		}
+
+		if idx >= 0 {
+			p.afterThink = p.inThink
+			p.inThink = !p.inThink
+		}
+	}
+	return out.String(), thought.String()
+}
+
+// flush returns the text held back at the end of the stream.
+func (p *thinkParser) flush() (content, reasoning string) {
+	text := p.pending
+	p.pending = ""
+	if p.inThink {
+		return "", text
+	}
+	return text, ""
+}
+
+// partialSuffix returns the length of the longest suffix of s that is a
+// proper prefix of tag.
+func partialSuffix(s, tag string) int {
+	for n := len(tag) - 1; n > 0; n-- {
+		if strings.HasSuffix(s, tag[:n]) {
+			return n
+		}
+	}
+	return 0
+}
+
+// splitThink separates the think blocks of a complete answer.
+func splitThink(text string) (content, reasoning string) {
+	var p thinkParser
+	content, reasoning = p.feed(text)
+	c, r := p.flush()
+	return content + c, strings.TrimSpace(reasoning + r)
+}
@@ -0,0 +1,92 @@
+package main
+
+import "testing"
+
+func TestThinkParserSplitTags(t *testing.T) {
+	tests := []struct {
+		name      string
+		chunks    []string
+		content   string
+		reasoning string
+	}{
+		{
+			name:      "whole tags",
+			chunks:    []string{"<think>plan</think>\n\nanswer"},
+			content:   "answer",
+			reasoning: "plan",
+		},
+		{
+			name:      "opening tag split",
+			chunks:    []string{"<th", "ink>plan</think>answer"},
+			content:   "answer",
+			reasoning: "plan",
+		},
+		{
+			name:      "closing tag split in three",
+			chunks:    []string{"<think>plan</", "thi", "nk>\n", "\nanswer"},
+			content:   "answer",
+			reasoning: "plan",
+		},
+		{
+			name:      "one character per chunk",
+			chunks:    []string{"<", "t", "h", "i", "n", "k", ">", "a", "<", "/", "t", "h", "i", "n", "k", ">", "b"},
+			content:   "b",
+			reasoning: "a",
+		},
+		{
+			name:    "lookalike is not a tag",
+			chunks:  []string{"a <th", "ing> b"},
+			content: "a <thing> b",
+		},
+		{
+			name:    "partial tag at the end",
+			chunks:  []string{"x < y, so x <thi"},
+			content: "x < y, so x <thi",
+		},
+		{
+			name:      "unclosed think block",
+			chunks:    []string{"<think>still ", "thinking</thi"},
+			reasoning: "still thinking</thi",
+		},
+		{
+			name:      "text before and between blocks",
+			chunks:    []string{"a<think>1</think>", " b<think>2</think>c"},
+			content:   "abc",
+			reasoning: "12",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var p thinkParser
+			var content, reasoning string
+			for _, chunk := range tt.chunks {
+				c, r := p.feed(chunk)
+				content += c
+				reasoning += r
+			}
+			c, r := p.flush()
+			content += c
+			reasoning += r
+			if content != tt.content || reasoning != tt.reasoning {
+				t.Errorf("got content %q, reasoning %q, want %q, %q", content, reasoning, tt.content, tt.reasoning)
+			}
+		})
+	}
+}
+
+func TestThinkParserHoldsBackPartialTags(t *testing.T) {
+	var p thinkParser
+	if c, _ := p.feed("Hello <thi"); c != "Hello " {
+		t.Errorf("feed = %q, want the possible tag held back", c)
+	}
+	if c, r := p.feed("nk>"); c != "" || r != "" {
+		t.Errorf("feed = %q, %q, want nothing for the completed tag", c, r)
+	}
+}
+
+func TestSplitThink(t *testing.T) {
+	content, reasoning := splitThink("<think>\n  plan  \n</think>\n\nanswer")
+	if content != "answer" || reasoning != "plan" {
+		t.Errorf("splitThink = %q, %q", content, reasoning)
+	}
+}
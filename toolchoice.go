@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// forcedToolChoice is a tool_choice that makes a tool call mandatory: a named
+// function, or any function for "required". For backends that only support
+// "auto" the proxy narrows the tools, tells the model what to call and
+// checks that it did.
+type forcedToolChoice struct {
+	name string // empty for "required"
+}
+
+// parseForcedToolChoice returns the forced choice of a request, or nil when
+// the model may answer freely.
+func parseForcedToolChoice(chatReq *ChatRequest) *forcedToolChoice {
+	if len(requestTools(chatReq)) == 0 {
+		return nil
+	}
+	switch choice := chatReq.ToolChoice.(type) {
+	case string:
+		if choice == "required" {
+			return &forcedToolChoice{}
+		}
+	case map[string]interface{}:
+		if choice["type"] != "function" {
+			return nil
+		}
+		fn, _ := choice["function"].(map[string]interface{})
+		if name, _ := fn["name"].(string); name != "" {
+			return &forcedToolChoice{name: name}
+		}
+	}
+	return nil
+}
+
+func (tc *forcedToolChoice) String() string {
+	if tc.name == "" {
+		return "a function"
+	}
+	return "function " + tc.name
+}
+
+// apply returns the request as sent upstream: only the forced function is
+// offered, and a final system message steers the model to call it.
+func (tc *forcedToolChoice) apply(chatReq *ChatRequest) *ChatRequest {
+	req := *chatReq
+	tools := requestTools(chatReq)
+	if tc.name != "" {
+		var narrowed []Tool
+		for _, tool := range tools {
+			if tool.Function.Name == tc.name {
+				narrowed = append(narrowed, tool)
+			}
+		}
+		if len(narrowed) == 0 {
+			log.Printf("Forced function %s is not among the request's tools", tc.name)
+		} else {
+			tools = narrowed
+		}
+	}
+	req.Tools = tools
+	req.Functions = nil
+	req.ToolChoice = "auto"
+
+	// A retry already ends with a stronger instruction
+	req.Messages = chatReq.Messages
+	if last := len(req.Messages) - 1; last < 0 || !strings.HasSuffix(req.Messages[last].Content, tc.instruction()) {
+		req.Messages = append(append([]Message(nil), chatReq.Messages...), Message{
+			Role:    "system",
+			Content: tc.instruction(),
+		})
+	}
+	return &req
+}
+
+func (tc *forcedToolChoice) instruction() string {
+	if tc.name == "" {
+		return "Respond by calling one or more of the provided functions. Do not reply with text."
+	}
+	return fmt.Sprintf("Respond by calling the function %q with arguments that match its parameters. Do not reply with text.", tc.name)
+}
+
+// check fails answers that do not call the forced function.
+func (tc *forcedToolChoice) check(completion *chatCompletion) error {
+	for _, choice := range completion.Choices {
+		for _, call := range choice.Message.ToolCalls {
+			if tc.name == "" || call.Function.Name == tc.name {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("the answer did not call %s", tc)
+}
+
+// retry asks again with a stronger instruction, which apply keeps.
+func (tc *forcedToolChoice) retry(chatReq *ChatRequest, answer *chatCompletion, err error) *ChatRequest {
+	req := *chatReq
+	req.Messages = append(append([]Message(nil), chatReq.Messages...), Message{
+		Role:    "system",
+		Content: "Your previous answer did not call a function, which is not allowed here. " + tc.instruction(),
+	})
+	return &req
+}
+
+// strict is false: an answer without the call is still passed on.
+func (tc *forcedToolChoice) strict() bool {
+	return false
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Models without native tool support are told about the tools in the system
+// prompt and answer with a JSON object when they want to call them. The
+// proxy turns that object into OpenAI tool_calls.
+
+// toolSystemPrompt describes the tools and the format of a call.
+func toolSystemPrompt(tools []Tool) string {
+	var b strings.Builder
+	b.WriteString("You have access to the following tools:\n\n")
+	for _, tool := range tools {
+		params, err := json.Marshal(tool.Function.Parameters)
+		if err != nil || string(params) == "null" {
+			params = []byte("{}")
+		}
+		fmt.Fprintf(&b, "- %s: %s\n  Parameters (JSON Schema): %s\n", tool.Function.Name, tool.Function.Description, params)
+	}
+	b.WriteString("\nTo call one or more tools, reply with only a JSON object in exactly this format and no other text:\n")
+	b.WriteString(`{"tool_calls": [{"name": "<tool name>", "arguments": {<arguments>}}]}`)
+	b.WriteString("\n\nTool results are sent back to you in a user message. When no tool is needed, reply in plain text.")
+	return b.String()
+}
+
+// promptToolCall is a tool call in the format of the tool prompt
+type promptToolCall struct {
+	Name      string          `json:"name"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+// toolCallsText renders earlier tool calls of the assistant the way the
+// model was asked to write them.
+func toolCallsText(calls []ToolCall) string {
+	out := struct {
+		ToolCalls []promptToolCall `json:"tool_calls"`
+	}{}
+	for _, call := range calls {
+		args := json.RawMessage(call.Function.Arguments)
+		if !json.Valid(args) {
+			args, _ = json.Marshal(call.Function.Arguments)
+		}
+		out.ToolCalls = append(out.ToolCalls, promptToolCall{Name: call.Function.Name, Arguments: args})
+	}
+	data, _ := json.Marshal(out)
+	return string(data)
+}
+
+// toolResultText renders the result of a tool call for a user message.
+func toolResultText(name, id, result string) string {
+	if name == "" {
+		return fmt.Sprintf("Result of tool call %s:\n%s", id, result)
+	}
+	return fmt.Sprintf("Result of tool %s (call %s):\n%s", name, id, result)
+}
+
+// parseToolCallText returns the tool calls of an answer that consists of a
+// tool call object only, optionally in a ```json fence.
+func parseToolCallText(text string) ([]ToolCall, bool) {
+	text = strings.TrimSpace(text)
+	if strings.HasPrefix(text, "```") && strings.HasSuffix(text, "```") && len(text) >= 6 {
+		text = strings.TrimSpace(strings.TrimPrefix(text[3:len(text)-3], "json"))
+	}
+	if !strings.HasPrefix(text, "{") {
+		return nil, false
+	}
+
+	var out struct {
+		ToolCalls []promptToolCall `json:"tool_calls"`
+	}
+	if err := json.Unmarshal([]byte(text), &out); err != nil || len(out.ToolCalls) == 0 {
+		return nil, false
+	}
+
+	calls := make([]ToolCall, len(out.ToolCalls))
+	for i, pc := range out.ToolCalls {
+		if pc.Name == "" {
+			return nil, false
+		}
+		calls[i] = ToolCall{ID: newToolCallID(), Type: "function"}
+		calls[i].Function.Name = pc.Name
+		calls[i].Function.Arguments = toolArguments(pc.Arguments)
+	}
+	return calls, true
+}
+
+// toolArguments returns arguments given as a JSON object, or as a string
+// holding one, in the string form of OpenAI tool calls.
+func toolArguments(raw json.RawMessage) string {
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return s
+	}
+	if len(raw) == 0 || string(raw) == "null" {
+		return "{}"
+	}
+	return string(raw)
+}
+
+func newToolCallID() string {
+	buf := make([]byte, 12)
+	rand.Read(buf)
+	return "call_" + hex.EncodeToString(buf)
+}
+
+// toolCallDetector holds back streamed text that may be a tool call object
+// until the answer is complete. Text that cannot be one is passed on at once.
+type toolCallDetector struct {
+	decided bool
+	holding bool
+	held    strings.Builder
+}
+
+// feed returns the text that can be sent now.
+func (d *toolCallDetector) feed(text string) string {
+	if d.decided && !d.holding {
+		return text
+	}
+	d.held.WriteString(text)
+	if d.decided {
+		return ""
+	}
+
+	trimmed := strings.TrimLeft(d.held.String(), " \t\r\n")
+	switch {
+	case trimmed == "" || strings.HasPrefix("```", trimmed):
+		return ""
+	case strings.HasPrefix(trimmed, "{"):
+		d.decided, d.holding = true, true
+		return ""
+	case strings.HasPrefix(trimmed, "```"):
+		// Only a json or unlabelled fence may hold a tool call
+		line, _, complete := strings.Cut(trimmed[3:], "\n")
+		if !complete {
+			return ""
+		}
+		if lang := strings.TrimSpace(line); lang == "" || lang == "json" {
+			d.decided, d.holding = true, true
+			return ""
+		}
+	}
+
+	d.decided = true
+	out := d.held.String()
+	d.held.Reset()
+	return out
+}
+
+// flush ends the answer: held text is either a tool call or passed on.
+func (d *toolCallDetector) flush() (string, []ToolCall) {
+	text := d.held.String()
+	d.held.Reset()
+	if d.holding {
+		if calls, ok := parseToolCallText(text); ok {
+			return "", calls
+		}
+	}
+	return text, nil
+}
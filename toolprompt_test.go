@@ -0,0 +1,106 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseToolCallText(t *testing.T) {
+	tests := []struct {
+		name  string
+		text  string
+		calls []string // name and arguments of each call
+	}{
+		{"bare", `{"tool_calls": [{"name": "search", "arguments": {"q": "x"}}]}`, []string{`search {"q": "x"}`}},
+		{"json fence", "```json\n{\"tool_calls\": [{\"name\": \"a\", \"arguments\": {}}, {\"name\": \"b\"}]}\n```", []string{"a {}", "b {}"}},
+		{"unlabelled fence", "```\n{\"tool_calls\": [{\"name\": \"a\", \"arguments\": {}}]}\n```", []string{"a {}"}},
+		{"arguments as a string", `{"tool_calls": [{"name": "a", "arguments": "{\"n\":1}"}]}`, []string{`a {"n":1}`}},
+		{"text around the object", `Calling: {"tool_calls": [{"name": "a"}]}`, nil},
+		{"no calls", `{"tool_calls": []}`, nil},
+		{"call without a name", `{"tool_calls": [{"arguments": {}}]}`, nil},
+		{"other JSON", `{"answer": 42}`, nil},
+		{"invalid JSON", `{"tool_calls": [`, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls, ok := parseToolCallText(tt.text)
+			if ok != (tt.calls != nil) {
+				t.Fatalf("ok = %v, want %v", ok, tt.calls != nil)
+			}
+			var got []string
+			for _, call := range calls {
+				if !strings.HasPrefix(call.ID, "call_") || call.Type != "function" {
+					t.Errorf("call %+v lacks an id or type", call)
+				}
+				got = append(got, call.Function.Name+" "+call.Function.Arguments)
+			}
+			if strings.Join(got, "|") != strings.Join(tt.calls, "|") {
+				t.Errorf("calls = %q, want %q", got, tt.calls)
+			}
+		})
+	}
+}
+
+func TestToolCallDetector(t *testing.T) {
+	tests := []struct {
+		name     string
+		chunks   []string
+		streamed string // text passed on before the end
+		rest     string // text returned by flush
+		calls    int
+	}{
+		{
+			name:     "plain text streams at once",
+			chunks:   []string{"Hello", " world"},
+			streamed: "Hello world",
+		},
+		{
+			name:   "bare tool call",
+			chunks: []string{"  {\"tool_", "calls\": [{\"name\": \"a\"}]}"},
+			calls:  1,
+		},
+		{
+			name:   "fenced tool call split in the fence",
+			chunks: []string{"`", "``js", "on\n{\"tool_calls\": [{\"name\": \"a\"}]}\n", "```"},
+			calls:  1,
+		},
+		{
+			name:     "code fence of another language",
+			chunks:   []string{"```py", "thon\nprint(1)\n", "```"},
+			streamed: "```python\nprint(1)\n```",
+		},
+		{
+			name:   "held JSON that is no tool call",
+			chunks: []string{"{\"answer\": ", "42}"},
+			rest:   "{\"answer\": 42}",
+		},
+		{
+			name:   "unlabelled fence with code",
+			chunks: []string{"```\nfmt.Println(1)\n", "```"},
+			rest:   "```\nfmt.Println(1)\n```",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var d toolCallDetector
+			var streamed string
+			for _, chunk := range tt.chunks {
+				streamed += d.feed(chunk)
+			}
+			rest, calls := d.flush()
+			if streamed != tt.streamed || rest != tt.rest || len(calls) != tt.calls {
+				t.Errorf("streamed %q, rest %q, %d calls; want %q, %q, %d calls", streamed, rest, len(calls), tt.streamed, tt.rest, tt.calls)
+			}
+		})
+	}
+}
+
+func TestToolCallsTextRoundTrip(t *testing.T) {
+	var call ToolCall
+	call.Function.Name = "search"
+	call.Function.Arguments = `{"q":"x"}`
+	calls, ok := parseToolCallText(toolCallsText([]ToolCall{call}))
+	if !ok || len(calls) != 1 || calls[0].Function.Name != "search" || calls[0].Function.Arguments != `{"q":"x"}` {
+		t.Errorf("round trip = %+v, %v", calls, ok)
+	}
+}
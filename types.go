@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+)
+
+// Models response structure
+type ModelsResponse struct {
+	Object string  `json:"object"`
+	Data   []Model `json:"data"`
+}
+
+type Model struct {
+	ID      string `json:"id"`
+	Object  string `json:"object"`
+	Created int64  `json:"created"`
+	OwnedBy string `json:"owned_by"`
+}
+
+// OpenAI compatible request structure
+type ChatRequest struct {
+	Model       string      `json:"model"`
+	Messages    []Message   `json:"messages"`
+	Stream      bool        `json:"stream"`
+	Functions   []Function  `json:"functions,omitempty"`
+	Tools       []Tool      `json:"tools,omitempty"`
+	ToolChoice  interface{} `json:"tool_choice,omitempty"`
+	Temperature *float64    `json:"temperature,omitempty"`
+	MaxTokens   *int        `json:"max_tokens,omitempty"`
+
+	StreamOptions  *StreamOptions  `json:"stream_options,omitempty"`
+	ResponseFormat *ResponseFormat `json:"response_format,omitempty"`
+
+	// Images downloaded for backends that need the image data, shared by
+	// the copies of the request made for fallbacks and retries
+	images *imageCache
+}
+
+// StreamOptions are the OpenAI options of a streamed completion
+type StreamOptions struct {
+	// IncludeUsage asks for a final chunk with the usage of the request
+	IncludeUsage bool `json:"include_usage"`
+}
+
+// ResponseFormat is the OpenAI response_format: "text", "json_object" or
+// "json_schema"
+type ResponseFormat struct {
+	Type       string            `json:"type"`
+	JSONSchema *JSONSchemaFormat `json:"json_schema,omitempty"`
+}
+
+type JSONSchemaFormat struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Schema      json.RawMessage `json:"schema,omitempty"`
+	Strict      *bool           `json:"strict,omitempty"`
+}
+
+// includeUsage reports whether the client asked for a usage chunk.
+func (chatReq *ChatRequest) includeUsage() bool {
+	return chatReq.StreamOptions != nil && chatReq.StreamOptions.IncludeUsage
+}
+
+type Message struct {
+	Role       string     `json:"role"`
+	Content    string     `json:"content"`
+	ToolCalls  []ToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string     `json:"tool_call_id,omitempty"`
+	Name       string     `json:"name,omitempty"`
+
+	// Chain of thought of reasoning models like deepseek-reasoner
+	ReasoningContent string `json:"reasoning_content,omitempty"`
+
+	// Parts is the content when it was sent as an array of parts; Content
+	// then holds their text
+	Parts []ContentPart `json:"-"`
+}
+
+type Function struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Parameters  any    `json:"parameters"`
+}
+
+type Tool struct {
+	Type     string   `json:"type"`
+	Function Function `json:"function"`
+}
+
+type ToolCall struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Function struct {
+		Name      string `json:"name"`
+		Arguments string `json:"arguments"`
+	} `json:"function"`
+}
+
+// Usage is the token accounting block of an OpenAI response
+type Usage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+
+	// DeepSeek context caching
+	PromptCacheHitTokens  int `json:"prompt_cache_hit_tokens,omitempty"`
+	PromptCacheMissTokens int `json:"prompt_cache_miss_tokens,omitempty"`
+
+	// OpenAI-style caching, as reported by OpenRouter
+	PromptTokensDetails *struct {
+		CachedTokens int `json:"cached_tokens"`
+	} `json:"prompt_tokens_details,omitempty"`
+}
+
+// cachedTokens returns how many prompt tokens the upstream served from its
+// cache.
+func (u *Usage) cachedTokens() int {
+	if u.PromptCacheHitTokens > 0 {
+		return u.PromptCacheHitTokens
+	}
+	if u.PromptTokensDetails != nil {
+		return u.PromptTokensDetails.CachedTokens
+	}
+	return 0
+}
+
+// plus returns the usage of two requests together; either may be nil. The
+// cache split is kept in DeepSeek's fields, which pricing reads first.
+func (u *Usage) plus(v *Usage) *Usage {
+	if u == nil {
+		return v
+	}
+	if v == nil {
+		return u
+	}
+	cacheMiss := func(u *Usage) int {
+		if u.PromptCacheMissTokens > 0 {
+			return u.PromptCacheMissTokens
+		}
+		return u.PromptTokens - u.cachedTokens()
+	}
+	return &Usage{
+		PromptTokens:          u.PromptTokens + v.PromptTokens,
+		CompletionTokens:      u.CompletionTokens + v.CompletionTokens,
+		TotalTokens:           u.TotalTokens + v.TotalTokens,
+		PromptCacheHitTokens:  u.cachedTokens() + v.cachedTokens(),
+		PromptCacheMissTokens: cacheMiss(u) + cacheMiss(v),
+	}
+}
+
+// estimateTokens roughly estimates the token count of s at four characters
+// per token, which is close enough for accounting before real usage is known.
+func estimateTokens(s string) int {
+	return (len(s) + 3) / 4
+}
+
+// estimatePromptTokens estimates the prompt size of a request.
+func estimatePromptTokens(chatReq *ChatRequest) int {
+	total := 0
+	for _, msg := range chatReq.Messages {
+		// Every message carries a few tokens of framing
+		total += 4 + estimateTokens(msg.Content)
+		for _, tc := range msg.ToolCalls {
+			total += estimateTokens(tc.Function.Name) + estimateTokens(tc.Function.Arguments)
+		}
+	}
+	for _, tool := range requestTools(chatReq) {
+		if params, err := json.Marshal(tool.Function.Parameters); err == nil {
+			total += estimateTokens(string(params))
+		}
+		total += estimateTokens(tool.Function.Name) + estimateTokens(tool.Function.Description)
+	}
+	return total
+}
+
+// requestTools returns the request's tools, converting legacy functions to the
+// tools format when no tools are given.
+func requestTools(chatReq *ChatRequest) []Tool {
+	if len(chatReq.Tools) > 0 {
+		return chatReq.Tools
+	}
+	if len(chatReq.Functions) == 0 {
+		return nil
+	}
+
+	tools := make([]Tool, len(chatReq.Functions))
+	for i, fn := range chatReq.Functions {
+		tools[i] = Tool{
+			Type:     "function",
+			Function: fn,
+		}
+	}
+	return tools
+}
+
+func convertToolChoice(choice interface{}) string {
+	if choice == nil {
+		return ""
+	}
+
+	// If string "auto" or "none"
+	if str, ok := choice.(string); ok {
+		switch str {
+		case "auto", "none":
+			return str
+		}
+	}
+
+	// Try to parse as map for function call
+	if choiceMap, ok := choice.(map[string]interface{}); ok {
+		if choiceMap["type"] == "function" {
+			return "auto" // DeepSeek doesn't support specific function selection; forcedToolChoice emulates it
+		}
+	}
+
+	return ""
+}
+
+func convertMessages(messages []Message) []Message {
+	converted := make([]Message, len(messages))
+	for i, msg := range messages {
+		log.Printf("Converting message %d - Role: %s", i, msg.Role)
+		converted[i] = msg
+
+		// Handle assistant messages with tool calls
+		if msg.Role == "assistant" && len(msg.ToolCalls) > 0 {
+			log.Printf("Processing assistant message with %d tool calls", len(msg.ToolCalls))
+			// DeepSeek expects tool_calls in a specific format
+			toolCalls := make([]ToolCall, len(msg.ToolCalls))
+			for j, tc := range msg.ToolCalls {
+				toolCalls[j] = ToolCall{
+					ID:       tc.ID,
+					Type:     "function",
+					Function: tc.Function,
+				}
+				log.Printf("Tool call %d - ID: %s, Function: %s", j, tc.ID, tc.Function.Name)
+			}
+			converted[i].ToolCalls = toolCalls
+		}
+
+		// Handle function response messages
+		if msg.Role == "function" {
+			log.Printf("Converting function response to tool response")
+			// Convert to tool response format
+			converted[i].Role = "tool"
+		}
+	}
+
+	// Earlier reasoning is not sent back upstream
+	stripReasoning(converted)
+
+	// Log the final converted messages
+	for i, msg := range converted {
+		log.Printf("Final message %d - Role: %s, Content: %s", i, msg.Role, truncateString(msg.Content, 50))
+		if len(msg.ToolCalls) > 0 {
+			log.Printf("Message %d has %d tool calls", i, len(msg.ToolCalls))
+		}
+	}
+
+	return converted
+}
+
+func truncateString(s string, maxLen int) string {
+	if len(s) <= maxLen {
+		return s
+	}
+	return s[:maxLen] + "..."
+}